@@ -3,8 +3,11 @@ package asm
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
-	"strconv"
+	"errors"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
 	"strings"
 )
 
@@ -19,316 +22,1009 @@ const (
 // successful tinyvm program.
 type assembler struct {
 	labels     map[string]int
-	setLabels  map[int]string
+	labelPos   map[string]Pos         // positions of the label definitions
+	dataLabels map[string]bool        // labels defined in the data section
+	consts     map[string][]*constant // constants defined by .equ and .set
+	refs       map[int]*reference     // operands resolved at link time by instruction
 	pc         int
+	seq        int // number of constant definitions
+
+	instructions []Instruction // parsed instructions
+
+	macros     map[string]*macro // defined macros
+	defining   *macro            // macro currently being defined
+	expansions int               // number of macro expansions
+
+	fsys         fs.FS    // file system to include files from
+	includePaths []string // directories searched by .include
+	files        []string // files being included, outermost first
+
+	section  Section          // section currently being assembled
+	data     []byte           // data section
+	dataRefs map[int]*dataRef // data values resolved at link time by offset
+
+	relocatable bool             // assembling a module, see AssembleModule
+	globals     map[string]token // symbols exported by .global
+	externs     map[string]token // symbols imported by .extern
+	relocs      []Reloc          // relocations of the module
+
+	entry     *reference // entry point set by .entry, if any
+	entryAddr uint32     // address of the entry point
+
+	pos  []Pos     // source positions of the parsed instructions
+	errs ErrorList // errors found during assembly
 }
 
 // Assemble takes code as input and returns the compiled binary code
-// or an error if it failed.
+// or an error if it failed. If the code contains errors Assemble
+// returns an ErrorList containing all of them.
 func Assemble(code string) ([]byte, error) {
-	assembler := &assembler{
-		labels:    make(map[string]int),
-		setLabels: make(map[int]string),
+	bin, _, err := AssembleWithSymbols(code)
+	return bin, err
+}
+
+// AssembleWithSymbols assembles code like Assemble and additionally returns
+// the symbol table containing the addresses of all code labels. Programs
+// with a data section must be assembled using AssembleObject.
+func AssembleWithSymbols(code string) ([]byte, SymbolTable, error) {
+	obj, symbols, err := AssembleObject(code)
+	if err != nil {
+		return nil, nil, err
 	}
-	return assembler.assemble(code)
+	if len(obj.Data) > 0 {
+		return nil, nil, errors.New("program has a data section, use AssembleObject")
+	}
+	return obj.Code, symbols, nil
 }
 
-// assemble take code as input and assembles the instructions and returns
-// an error if it failed.
-func (p assembler) assemble(code string) ([]byte, error) {
-	var instructions []Instruction
-	for _, line := range strings.Split(code, "\n") {
-		// trim comments
-		if idx := strings.Index(line, comment); idx > 0 {
-			line = line[:idx]
-		}
+// AssembleObject assembles code in to an object containing both the code
+// and the data section and returns the symbol table containing the
+// addresses of all code labels. Code containing .include directives must
+// be assembled using AssembleFS.
+func AssembleObject(code string) (*Object, SymbolTable, error) {
+	return newAssembler(nil, nil).assembleObject("", code)
+}
 
-		// trim all whitespace
-		line = strings.TrimSpace(strings.Replace(line, "\t", " ", -1))
-		if len(line) == 0 {
-			continue
-		}
+// AssembleProgram assembles code in to a program consisting of the object
+// and the symbol table, which allows the labels of the program to be
+// called by name (see vm.VM.Call).
+func AssembleProgram(code string) (*Program, error) {
+	obj, symbols, err := AssembleObject(code)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{Object: *obj, Symbols: symbols}, nil
+}
 
-		switch {
-		case isLabel(line):
-			line = strings.TrimSuffix(line, labelType)
-			p.labels[line] = p.pc
-		default:
-			var splitStr []string
-			for _, str := range strings.Split(line, " ") {
-				if len(str) > 0 {
-					splitStr = append(splitStr, str)
-				}
-			}
-			splitStr[0] = strings.TrimSpace(splitStr[0])
+// AssembleFS assembles the file name of fsys like AssembleObject. Files
+// included by .include are looked up relative to the including file first
+// and then in the include paths of fsys, in the given order. Errors are
+// reported as file:line:col.
+func AssembleFS(fsys fs.FS, name string, includePaths ...string) (*Object, SymbolTable, error) {
+	a, code, err := newFileAssembler(fsys, name, includePaths)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.assembleObject(name, code)
+}
 
-			instrs, err := p.parseInstrs(splitStr)
-			if err != nil {
-				return nil, err
-			}
+// AssembleModule assembles code in to a relocatable module, which is
+// combined with other modules in to an executable object by Link. Labels
+// exported by .global may be imported by other modules using .extern.
+func AssembleModule(code string) (*Module, error) {
+	a := newAssembler(nil, nil)
+	a.relocatable = true
+	return a.assembleModule("", code)
+}
+
+// AssembleModuleFS assembles the file name of fsys in to a relocatable
+// module like AssembleModule. Includes are looked up like AssembleFS.
+func AssembleModuleFS(fsys fs.FS, name string, includePaths ...string) (*Module, error) {
+	a, code, err := newFileAssembler(fsys, name, includePaths)
+	if err != nil {
+		return nil, err
+	}
+	a.relocatable = true
+	return a.assembleModule(name, code)
+}
+
+func newAssembler(fsys fs.FS, includePaths []string) *assembler {
+	return &assembler{
+		labels:       make(map[string]int),
+		labelPos:     make(map[string]Pos),
+		dataLabels:   make(map[string]bool),
+		consts:       make(map[string][]*constant),
+		refs:         make(map[int]*reference),
+		dataRefs:     make(map[int]*dataRef),
+		macros:       make(map[string]*macro),
+		globals:      make(map[string]token),
+		externs:      make(map[string]token),
+		fsys:         fsys,
+		includePaths: includePaths,
+	}
+}
 
-			instructions = append(instructions, instrs...)
-			// increment program count by the amount of instructions
-			p.pc += len(instrs)
+// newFileAssembler returns an assembler for the file name of fsys and the
+// contents of the file.
+func newFileAssembler(fsys fs.FS, name string, includePaths []string) (*assembler, string, error) {
+	code, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, "", err
+	}
+	a := newAssembler(fsys, includePaths)
+	a.files = []string{path.Clean(name)}
+	return a, string(code), nil
+}
+
+// assembleObject assembles the code of file in to an object.
+func (a *assembler) assembleObject(file, code string) (*Object, SymbolTable, error) {
+	bin, err := a.assemble(file, code)
+	if err != nil {
+		return nil, nil, err
+	}
+	symbols := make(SymbolTable, len(a.labels))
+	for label, addr := range a.labels {
+		if !a.dataLabels[label] {
+			symbols[label] = uint32(addr)
 		}
 	}
-	// link the instructions
-	p.link(instructions)
+	return &Object{Entry: a.entryAddr, Code: bin, Data: a.data}, symbols, nil
+}
+
+// assembleModule assembles the code of file in to a relocatable module.
+func (a *assembler) assembleModule(file, code string) (*Module, error) {
+	bin, err := a.assemble(file, code)
+	if err != nil {
+		return nil, err
+	}
+	m := &Module{Name: file, Code: bin, Data: a.data, Relocs: a.relocs}
+	for label, addr := range a.labels {
+		sym := Symbol{Name: label, Section: TextSection, Value: uint32(addr)}
+		if a.dataLabels[label] {
+			sym.Section = DataSection
+		}
+		_, sym.Global = a.globals[label]
+		m.Symbols = append(m.Symbols, sym)
+	}
+	for name := range a.externs {
+		m.Symbols = append(m.Symbols, Symbol{Name: name, Section: UndefSection, Global: true})
+	}
+	sort.Slice(m.Symbols, func(i, j int) bool { return m.Symbols[i].Name < m.Symbols[j].Name })
+	return m, nil
+}
+
+// assemble take code as input and assembles the instructions and returns
+// an error if it failed.
+func (a *assembler) assemble(file, code string) ([]byte, error) {
+	a.parseSource(file, code, nil)
+	if a.defining != nil {
+		a.errs = append(a.errs, errorf(a.defining.name, "macro %q: missing .endm", a.defining.name.text))
+	}
+	a.checkGlobals()
+	instructions := a.instructions
+
+	// link the instructions, whose errors are reported in source order
+	// along with the parse errors
+	a.link(instructions)
+	if len(a.errs) > 0 {
+		a.errs.Sort()
+		return nil, a.errs
+	}
 
 	// encode to binary
 	writer := new(bytes.Buffer)
-	for _, instr := range instructions {
+	for i, instr := range instructions {
 		encoded, err := EncodeInstruction(instr)
 		if err != nil {
-			return nil, fmt.Errorf("%s: unexpected error: %v", instr.Op, err)
+			a.errs = append(a.errs, &Error{Pos: a.pos[i], Token: instr.Op.String(), Msg: err.Error()})
+			continue
 		}
 		binary.Write(writer, binary.BigEndian, encoded)
 	}
+	if len(a.errs) > 0 {
+		return nil, a.errs
+	}
 
 	return writer.Bytes(), nil
 }
 
-// parseInstrs attemps to parse the given args in a set of instructions
-func (a assembler) parseInstrs(args []string) ([]Instruction, error) {
-	var (
-		instructions []Instruction
-		op, cond, s  = a.parseOp(args[0])
-	)
-	args = args[1:]
-
-	// If the instruction is a pseudo op code take special care.
-	// Usually these instruction involve returning multiple parse
-	// instructions.
-	if isPseudoInstr(op) {
-		switch op {
-		case Push:
-			if len(args) != 1 {
-				return nil, opArgError(op, 1, len(args))
-			}
-			if !isRegister(args[0]) {
-				return nil, fmt.Errorf("%s: dst must be register: %s", op, args[0])
-			}
-			dst, err := strconv.Atoi(args[0][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
-			}
+// parseSource parses the source code of file, which is empty unless the
+// code is read from a file system.
+func (a *assembler) parseSource(file, code string, exp *expansion) {
+	for i, line := range strings.Split(code, "\n") {
+		a.parseLine(line, file, i+1, exp)
+	}
+}
 
-			instructions = []Instruction{
-				{Op: Sub, Dst: SP, Ops1: SP, Immediate: true, Value: 1},
-				{Op: Stm, Mode: DataTransfer, Dst: RegEntry(dst), Ops1: SP},
-			}
-		case Pop:
-			if len(args) != 1 {
-				return nil, opArgError(op, 1, len(args))
-			}
-			if !isRegister(args[0]) {
-				return nil, fmt.Errorf("%s: dst must be register: %s", op, args[0])
-			}
-			dst, err := strconv.Atoi(args[0][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
-			}
+// parseLine parses a single line of source code. Lines of macro
+// expansions carry the expansion they are part of.
+func (a *assembler) parseLine(line, file string, lineNum int, exp *expansion) {
+	toks := tokenize(line, file, lineNum)
+	// lines of a macro definition are collected until .endm
+	if a.defining != nil {
+		a.collectMacroLine(line, file, lineNum, toks)
+		return
+	}
+	if len(toks) == 0 {
+		return
+	}
+	for i := range toks {
+		toks[i].exp = exp
+	}
 
-			instructions = []Instruction{
-				{Op: Ldm, Mode: DataTransfer, Dst: RegEntry(dst), Ops1: SP},
-				{Op: Add, Dst: SP, Ops1: SP, Immediate: true, Value: 1},
-			}
+	// labels may be followed by an instruction on the same line
+	if isLabel(toks[0].text) {
+		a.defineLabel(toks[0])
+
+		if toks = toks[1:]; len(toks) == 0 {
+			return
 		}
-	} else {
-		instr := Instruction{
+	}
+	if isDirective(toks[0].text) {
+		if err := a.directive(toks[0], toks[1:]); err != nil {
+			a.errs = append(a.errs, err)
+		}
+		return
+	}
+	if m, ok := a.macros[toks[0].text]; ok {
+		if err := a.expandMacro(m, toks[0], toks[1:]); err != nil {
+			a.errs = append(a.errs, err)
+		}
+		return
+	}
+	if a.section == DataSection {
+		a.errs = append(a.errs, errorf(toks[0], "instruction %q in data section", toks[0].text))
+		return
+	}
+
+	instrs, err := a.parseInstrs(toks[0], toks[1:])
+	if err != nil {
+		a.errs = append(a.errs, err)
+		return
+	}
+	for range instrs {
+		a.pos = append(a.pos, toks[0].pos)
+	}
+
+	a.instructions = append(a.instructions, instrs...)
+	// increment program count by the amount of instructions
+	a.pc += len(instrs)
+}
+
+// parseInstrs attemps to parse the given args in a set of instructions
+func (a *assembler) parseInstrs(opTok token, args []token) ([]Instruction, *Error) {
+	op, cond, s, ok := parseOp(opTok.text)
+	if !ok {
+		return nil, errorf(opTok, "unknown mnemonic %q", opTok.text)
+	}
+
+	var (
+		instr = Instruction{
+			Mode: op.Mode(),
 			Cond: cond,
 			Op:   op,
 			S:    s,
 		}
-		switch op {
-		case Cmp:
-			if len(args) != 2 {
-				return nil, opArgError(op, 2, len(args))
-			}
-			if !isRegister(args[0]) {
-				return nil, fmt.Errorf("%s: dst must be register: %s", op, args[0])
+		err *Error
+	)
+	switch op {
+	case Cmp:
+		if err := checkArgs(op, opTok, args, 2, 2); err != nil {
+			return nil, err
+		}
+		if instr.Dst, err = parseRegister(op, args[0]); err != nil {
+			return nil, err
+		}
+		if err := a.parseOperand(op, args[1], &instr.Ops1, &instr); err != nil {
+			return nil, err
+		}
+	case Mov, Ldm, Stm, Ldrb, Strb, Ldrh, Strh:
+		// loads and stores address memory relative to a base register
+		// using [rN, off], [rN, off]! or [rN], off.
+		indexed := isTransfer(op) && len(args) > 1 && strings.HasPrefix(args[1].text, "[")
+		max := 2
+		if indexed {
+			max = 3
+		}
+		if err := checkArgs(op, opTok, args, 2, max); err != nil {
+			return nil, err
+		}
+		if instr.Dst, err = parseRegister(op, args[0]); err != nil {
+			return nil, err
+		}
+		if indexed {
+			if err := a.parseAddress(op, args[1:], &instr); err != nil {
+				return nil, err
 			}
-			if !isRegister(args[1]) {
-				return nil, fmt.Errorf("%s: ops1 must be register: %s", op, args[0])
+			break
+		}
+		// ldr rN =value loads an arbitrary constant or label address
+		if op == Ldm && strings.HasPrefix(args[1].text, literalPrefix) {
+			return a.parseLiteral(instr, args[1])
+		}
+		// immediates which can't be encoded are split up
+		if op == Mov && isImmediate(args[1].text) {
+			return a.parseLoad(instr, args[1], len(numberPrefix), "symbol")
+		}
+		// register, immediate or label
+		if isExpr(args[1].text) {
+			if err := a.parseReference(op, args[1]); err != nil {
+				return nil, err
 			}
-
-			dst, err := strconv.Atoi(args[0][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
+		} else if err := a.parseOperand(op, args[1], &instr.Ops1, &instr); err != nil {
+			return nil, err
+		}
+	case Movw, Movt:
+		if err := checkArgs(op, opTok, args, 2, 2); err != nil {
+			return nil, err
+		}
+		if instr.Dst, err = parseRegister(op, args[0]); err != nil {
+			return nil, err
+		}
+		// 16 bit immediate or label, of which a movw uses the bottom
+		// and a movt the top half.
+		instr.Immediate = true
+		if !isImmediate(args[1].text) {
+			if err := a.parseReference(op, args[1]); err != nil {
+				return nil, err
 			}
-			ops1, err := strconv.Atoi(args[1][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
+			break
+		}
+		value, ref, err := a.parseValue(op.String(), args[1], len(numberPrefix), "symbol")
+		if err != nil {
+			return nil, err
+		}
+		if ref != nil {
+			a.refs[a.pc] = ref
+		} else if value > MaxWideImmediate {
+			return nil, errorf(args[1], "%s: immediate %q out of range (max %d)", op, args[1].text, MaxWideImmediate)
+		}
+		instr.Value = value
+	case Add, Sub, Mul, Div, Rsb, And, Xor, Orr, Lsl, Lsr, Asr, Ror, Sdiv, Mod, Smod:
+		if err := checkArgs(op, opTok, args, 3, 3); err != nil {
+			return nil, err
+		}
+		if instr.Dst, err = parseRegister(op, args[0]); err != nil {
+			return nil, err
+		}
+		if instr.Ops1, err = parseRegister(op, args[1]); err != nil {
+			return nil, err
+		}
+		if err := a.parseOperand(op, args[2], &instr.Ops2, &instr); err != nil {
+			return nil, err
+		}
+	case Mla:
+		if err := checkArgs(op, opTok, args, 4, 4); err != nil {
+			return nil, err
+		}
+		for i, reg := range []*RegEntry{&instr.Dst, &instr.Ops1, &instr.Ops2, &instr.Ops3} {
+			if *reg, err = parseRegister(op, args[i]); err != nil {
+				return nil, err
 			}
-			instr.Dst = RegEntry(dst)
-			instr.Ops1 = RegEntry(ops1)
-		case Mov:
-			if len(args) != 2 {
-				return nil, opArgError(op, 2, len(args))
+		}
+	case B, Bl:
+		if err := checkArgs(op, opTok, args, 1, 1); err != nil {
+			return nil, err
+		}
+		// label, whose offset is computed at link time, or offset
+		instr.Immediate = true
+		if isExpr(args[0].text) {
+			if err := a.parseReference(op, args[0]); err != nil {
+				return nil, err
 			}
-			if !isRegister(args[0]) {
-				return nil, fmt.Errorf("%s: dst must be register: %s", op, args[0])
+			a.refs[a.pc].pcrel = true
+			break
+		}
+		if !isImmediate(args[0].text) {
+			return nil, errorf(args[0], "%s: expected label or offset, got %q", op, args[0].text)
+		}
+		value, ref, err := a.parseValue(op.String(), args[0], len(numberPrefix), "symbol")
+		if err != nil {
+			return nil, err
+		}
+		if ref != nil {
+			a.refs[a.pc] = ref
+		} else if !isBranchOffset(int64(int32(value))) {
+			return nil, errorf(args[0], "%s: offset %q out of range (min %d, max %d)", op, args[0].text, MinBranchOffset, MaxBranchOffset)
+		}
+		instr.Value = value
+	case Blx, Bx:
+		if err := checkArgs(op, opTok, args, 1, 1); err != nil {
+			return nil, err
+		}
+		if instr.Ops1, err = parseRegister(op, args[0]); err != nil {
+			return nil, err
+		}
+	case Push, Pop:
+		if err := checkArgs(op, opTok, args, 1, 1); err != nil {
+			return nil, err
+		}
+		if instr.Regs, err = parseRegList(op, args[0]); err != nil {
+			return nil, err
+		}
+	case Ret:
+		if err := checkArgs(op, opTok, args, 0, 0); err != nil {
+			return nil, err
+		}
+	case Svc:
+		if err := checkArgs(op, opTok, args, 1, 1); err != nil {
+			return nil, err
+		}
+		// 16 bit syscall number
+		if !isImmediate(args[0].text) {
+			return nil, errorf(args[0], "%s: expected immediate, got %q", op, args[0].text)
+		}
+		instr.Immediate = true
+		value, ref, err := a.parseValue(op.String(), args[0], len(numberPrefix), "symbol")
+		if err != nil {
+			return nil, err
+		}
+		if ref != nil {
+			a.refs[a.pc] = ref
+		} else if value > MaxWideImmediate {
+			return nil, errorf(args[0], "%s: syscall number %q out of range (max %d)", op, args[0].text, MaxWideImmediate)
+		}
+		instr.Value = value
+	case Stop:
+		if err := checkArgs(op, opTok, args, 0, 1); err != nil {
+			return nil, err
+		}
+		// the exit code is optional and defaults to 0
+		instr.Immediate = true
+		if len(args) == 1 {
+			if err := a.parseOperand(op, args[0], &instr.Ops1, &instr); err != nil {
+				return nil, err
 			}
+		}
+	}
+	return []Instruction{instr}, nil
+}
 
-			dst, err := strconv.Atoi(args[0][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
-			}
+// checkArgs returns an error if the amount of arguments is not within
+// the given bounds.
+func checkArgs(op Op, opTok token, args []token, min, max int) *Error {
+	if len(args) >= min && len(args) <= max {
+		return nil
+	}
+	if len(args) > max {
+		return errorf(args[max], "%s: too many arguments: expected %d, got %d", op, max, len(args))
+	}
+	return errorf(opTok, "%s: not enough arguments: expected %d, got %d", op, min, len(args))
+}
 
-			instr.Dst = RegEntry(dst)
-			if isImmediate(args[1]) {
-				ops, err := strconv.Atoi(args[1][1:])
-				if err != nil {
-					return nil, fmt.Errorf("%s: unexepected error: %v", op, err)
-				}
-				instr.Immediate = true
-				instr.Value = uint32(ops)
-			} else {
-				ops, err := strconv.Atoi(args[1][1:])
-				if err != nil {
-					// Expect a string. TODO fix this
-					a.setLabels[a.pc] = args[1]
-				}
-				instr.Ops1 = RegEntry(ops)
-			}
-		case Add, Sub, Mul, Div, Rsb, And, Xor, Orr, Lsl, Lsr:
-			if len(args) != 3 {
-				return nil, opArgError(op, 3, len(args))
+// parseRegister parses tok as register.
+func parseRegister(op Op, tok token) (RegEntry, *Error) {
+	reg, ok := StringToReg[tok.text]
+	if !ok {
+		if looksLikeRegister(tok.text) {
+			return 0, errorf(tok, "%s: invalid register %q", op, tok.text)
+		}
+		return 0, errorf(tok, "%s: expected register, got %q", op, tok.text)
+	}
+	return reg, nil
+}
+
+// parseRegList parses tok as register list of push and pop, which is either
+// a single register or a braced list of registers and register ranges (e.g.
+// {r4-r7, lr}). The stack pointer can't be part of the list.
+func parseRegList(op Op, tok token) (uint16, *Error) {
+	if !strings.HasPrefix(tok.text, "{") {
+		reg, err := parseRegister(op, tok)
+		if err != nil {
+			return 0, err
+		}
+		if reg == SP {
+			return 0, errorf(tok, "%s: stack pointer not allowed in register list", op)
+		}
+		return 1 << reg, nil
+	}
+	if !strings.HasSuffix(tok.text, "}") {
+		return 0, errorf(tok, "%s: unterminated register list %q", op, tok.text)
+	}
+
+	list := strings.TrimSpace(tok.text[1 : len(tok.text)-1])
+	if list == "" {
+		return 0, errorf(tok, "%s: empty register list", op)
+	}
+	var regs uint16
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return 0, errorf(tok, "%s: empty register in list %q", op, tok.text)
+		}
+		from, to, isRange := strings.Cut(field, "-")
+		first, err := parseRegister(op, token{text: strings.TrimSpace(from), pos: tok.pos})
+		if err != nil {
+			return 0, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseRegister(op, token{text: strings.TrimSpace(to), pos: tok.pos}); err != nil {
+				return 0, err
 			}
-			if !isRegister(args[0]) {
-				return nil, fmt.Errorf("%s: dst must be register: %s", op, args[0])
+			if last < first {
+				return 0, errorf(tok, "%s: invalid register range %q", op, field)
 			}
-			if !isRegister(args[1]) {
-				return nil, fmt.Errorf("%s: ops1 must be register: %s", op, args[0])
+		}
+		for reg := first; reg <= last; reg++ {
+			switch {
+			case reg == SP:
+				return 0, errorf(tok, "%s: stack pointer not allowed in register list", op)
+			case regs&(1<<reg) != 0:
+				return 0, errorf(tok, "%s: duplicate register %s in list %q", op, reg, tok.text)
 			}
+			regs |= 1 << reg
+		}
+	}
+	return regs, nil
+}
 
-			dst, err := strconv.Atoi(args[0][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
-			}
-			ops1, err := strconv.Atoi(args[1][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
-			}
+// parseAddress parses the bracketed address operand of a load or store,
+// which is one of [rN], [rN, off], [rN, off]! or the post-indexed [rN], off
+// spanning two arguments. The offset is a register or immediate.
+func (a *assembler) parseAddress(op Op, args []token, instr *Instruction) *Error {
+	tok := args[0]
+	text := strings.TrimSuffix(tok.text, "!")
+	writeback := text != tok.text
+	if !strings.HasSuffix(text, "]") {
+		return errorf(tok, "%s: unterminated address %q", op, tok.text)
+	}
+	fields := strings.Split(text[1:len(text)-1], ",")
+	if len(fields) > 2 {
+		return errorf(tok, "%s: invalid address %q: expected [rN] or [rN, offset]", op, tok.text)
+	}
+	base, err := parseRegister(op, token{text: strings.TrimSpace(fields[0]), pos: tok.pos})
+	if err != nil {
+		return err
+	}
+	instr.Ops1 = base
 
-			instr.Dst = RegEntry(dst)
-			instr.Ops1 = RegEntry(ops1)
+	switch {
+	case len(args) > 1:
+		if len(fields) > 1 || writeback {
+			return errorf(tok, "%s: post-indexed address %q must be [rN]", op, tok.text)
+		}
+		instr.Addr = AddrPostIndex
+		return a.parseOffset(op, args[1], instr)
+	case len(fields) == 1:
+		if writeback {
+			return errorf(tok, "%s: write back of %q requires an offset", op, tok.text)
+		}
+		// [rN] is the same as addressing by register
+		return nil
+	case writeback:
+		instr.Addr = AddrPreIndex
+	default:
+		instr.Addr = AddrOffset
+	}
+	return a.parseOffset(op, token{text: strings.TrimSpace(fields[1]), pos: tok.pos}, instr)
+}
 
-			ops2, err := strconv.Atoi(args[2][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexepected error: %v", op, err)
-			}
-			if isImmediate(args[2]) {
-				instr.Immediate = true
-				instr.Value = uint32(ops2)
-			} else {
-				instr.Ops2 = RegEntry(ops2)
-			}
-		case Call:
-			if len(args) != 1 {
-				return nil, opArgError(op, 1, len(args))
+// parseOffset parses tok as the register or signed immediate offset of an
+// indexed address.
+func (a *assembler) parseOffset(op Op, tok token, instr *Instruction) *Error {
+	if !isImmediate(tok.text) {
+		if !isRegister(tok.text) && !looksLikeRegister(tok.text) {
+			return errorf(tok, "%s: expected register or offset, got %q", op, tok.text)
+		}
+		reg, err := parseRegister(op, tok)
+		if err != nil {
+			return err
+		}
+		instr.Ops2 = reg
+		return nil
+	}
+	value, ref, err := a.parseImmediateValue(op, tok)
+	if err != nil {
+		return err
+	}
+	instr.Immediate = true
+	if ref != nil {
+		a.refs[a.pc] = ref
+	} else if !isTransferOffset(int64(int32(value))) {
+		return errorf(tok, "%s: offset %q out of range (min %d, max %d)", op, tok.text, MinTransferOffset, MaxTransferOffset)
+	}
+	instr.Value = value
+	return nil
+}
+
+// reference is an operand which can't be resolved until link time.
+type reference struct {
+	tok  token  // operand token
+	expr expr   // expression evaluating to the operand value
+	seq  int    // number of constant definitions preceding the reference
+	kind string // kind of symbol referred to (label or symbol)
+	// pcrel is set for branch targets, which are encoded as offset
+	// relative to the branch instruction.
+	pcrel bool
+	// byteAddr is set for operands of byte and halfword loads and stores,
+	// which take byte addresses. Data labels are scaled accordingly.
+	byteAddr bool
+}
+
+// parseValue parses the expression of tok, skipping the prefix, and
+// evaluates it using the symbols defined so far. If the expression refers
+// to symbols that aren't defined yet, or its value is relocatable, the
+// returned reference must be resolved at link time.
+func (a *assembler) parseValue(name string, tok token, skip int, kind string) (uint32, *reference, *Error) {
+	x, err := parseExpr(tok, skip)
+	if err != nil {
+		err.Msg = name + ": " + err.Msg
+		return 0, nil, err
+	}
+	return a.evalValue(name, &reference{tok: tok, expr: x, seq: a.seq, kind: kind})
+}
+
+// parseImmediateValue parses tok as the immediate operand of op, see
+// parseValue.
+func (a *assembler) parseImmediateValue(op Op, tok token) (uint32, *reference, *Error) {
+	x, err := parseExpr(tok, len(numberPrefix))
+	if err != nil {
+		err.Msg = op.String() + ": " + err.Msg
+		return 0, nil, err
+	}
+	return a.evalValue(op.String(), &reference{tok: tok, expr: x, seq: a.seq, kind: "symbol", byteAddr: isByteTransfer(op)})
+}
+
+// evalValue evaluates ref using the symbols defined so far. The reference
+// is returned if it can't be resolved until link time.
+func (a *assembler) evalValue(name string, ref *reference) (uint32, *reference, *Error) {
+	v, err := ref.expr.eval(a.refResolver(ref, false))
+	if err != nil || !v.isAbs() {
+		return 0, ref, nil
+	}
+	value, ok := toValue(v.n)
+	if !ok {
+		return 0, nil, errorf(ref.tok, "%s: immediate %q out of range (min %d, max %d)", name, ref.tok.text, math.MinInt32, uint32(math.MaxUint32))
+	}
+	return value, nil, nil
+}
+
+// parseReference parses tok as label reference, e.g. `loop` or `table+2`,
+// which is resolved at link time.
+func (a *assembler) parseReference(op Op, tok token) *Error {
+	x, err := parseExpr(tok, 0)
+	if err != nil {
+		err.Msg = op.String() + ": " + err.Msg
+		return err
+	}
+	a.refs[a.pc] = &reference{tok: tok, expr: x, seq: a.seq, kind: "label", byteAddr: isByteTransfer(op)}
+	return nil
+}
+
+// parseImmediate parses tok as immediate value of instr and verifies that
+// it can be encoded.
+func (a *assembler) parseImmediate(op Op, tok token, instr *Instruction) *Error {
+	if !isImmediate(tok.text) {
+		return errorf(tok, "%s: expected immediate, got %q", op, tok.text)
+	}
+	value, ref, err := a.parseImmediateValue(op, tok)
+	if err != nil {
+		return err
+	}
+	instr.Immediate = true
+	if ref != nil {
+		a.refs[a.pc] = ref
+		return nil
+	}
+	if !setImmediate(instr, value) {
+		return errorf(tok, "%s: immediate %q cannot be encoded (use ldr rN =value)", op, tok.text)
+	}
+	return nil
+}
+
+// setImmediate sets the immediate value of instr and reports whether it
+// can be encoded. Negative immediates of add and sub which can't be
+// encoded are negated by swapping the operation.
+func setImmediate(instr *Instruction, value uint32) bool {
+	instr.Immediate = true
+	if _, err := encodeImmediate(value); err == nil {
+		instr.Value = value
+		return true
+	}
+	if instr.Op != Add && instr.Op != Sub {
+		return false
+	}
+	if _, err := encodeImmediate(-value); err != nil {
+		return false
+	}
+	if instr.Op == Add {
+		instr.Op = Sub
+	} else {
+		instr.Op = Add
+	}
+	instr.Value = -value
+	return true
+}
+
+// parseLiteral parses the `ldr rN =value` pseudo instruction which loads a
+// constant or the address of a label in to a register.
+func (a *assembler) parseLiteral(instr Instruction, tok token) ([]Instruction, *Error) {
+	instr.Mode, instr.Op = DataProcessing, Mov
+	return a.parseLoad(instr, tok, len(literalPrefix), "label")
+}
+
+// parseLoad parses the value of tok, skipping the prefix, and returns the
+// instructions which load it in to the destination of instr. Values which
+// aren't known until link time are always loaded using movw and movt. The
+// pc can't be loaded in two instructions, as the first one would branch.
+func (a *assembler) parseLoad(instr Instruction, tok token, skip int, kind string) ([]Instruction, *Error) {
+	value, ref, err := a.parseValue(instr.Op.String(), tok, skip, kind)
+	if err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		if instrs := loadImmediate(instr, value); len(instrs) == 1 || instr.Dst != PC {
+			return instrs, nil
+		}
+	}
+	if instr.Dst == PC {
+		return nil, errorf(tok, "%s: cannot load %q in to pc in one instruction (load it in to rN and use bx rN)", instr.Op, tok.text)
+	}
+	lo, hi := instr, instr
+	lo.Op, lo.Immediate, lo.S = Movw, true, false
+	hi.Op, hi.Immediate = Movt, true
+	a.refs[a.pc] = ref
+	a.refs[a.pc+1] = ref
+	return []Instruction{lo, hi}, nil
+}
+
+// loadImmediate returns the instructions which move value in to the
+// destination of instr. Values that can't be encoded as immediate are
+// split up in to a movw and movt pair.
+func loadImmediate(instr Instruction, value uint32) []Instruction {
+	instr.Mode, instr.Immediate = DataProcessing, true
+	if _, err := encodeImmediate(value); err == nil {
+		instr.Op, instr.Value = Mov, value
+		return []Instruction{instr}
+	}
+
+	lo := instr
+	lo.Op, lo.Value = Movw, value&MaxWideImmediate
+	if value <= MaxWideImmediate {
+		return []Instruction{lo}
+	}
+	// only the last instruction sets the flags
+	hi := instr
+	hi.Op, hi.Value = Movt, value>>16
+	lo.S = false
+	return []Instruction{lo, hi}
+}
+
+// parseOperand parses tok as either a register, which is stored in reg, or
+// an immediate, which is stored in instr.
+func (a *assembler) parseOperand(op Op, tok token, reg *RegEntry, instr *Instruction) *Error {
+	if isImmediate(tok.text) {
+		return a.parseImmediate(op, tok, instr)
+	}
+	r, err := parseRegister(op, tok)
+	if err != nil {
+		return err
+	}
+	instr.Immediate = false
+	*reg = r
+	return nil
+}
+
+// condSuffixes contains the condition suffixes in the order in which
+// they are tried by parseOp.
+var condSuffixes = []string{
+	"gte", "lte",
+	"eq", "ne", "gt", "lt", "ge", "le", "hs", "lo", "hi", "ls", "mi", "pl", "vs", "vc", "al", "cs", "cc",
+}
+
+// parseOp parses the given op string in the form of op[s][cond] and
+// returns the opcode, conditional value and the S flag. It reports
+// whether the op string is valid.
+func parseOp(strOp string) (Op, Cond, bool, bool) {
+	// exact matches take precedence over condition suffixes (e.g. halt)
+	if op, ok := OpString[strOp]; ok {
+		return op, NoCond, false, true
+	}
+
+	var candidates []string
+	for _, suffix := range condSuffixes {
+		if strings.HasSuffix(strOp, suffix) {
+			candidates = append(candidates, suffix)
+		}
+	}
+	candidates = append(candidates, "")
+
+	for _, suffix := range candidates {
+		mnemonic, cond := strings.TrimSuffix(strOp, suffix), StringToCond[suffix]
+		if op, ok := OpString[mnemonic]; ok && suffix != "" {
+			return op, cond, false, true
+		}
+		// the S flag is only available for data processing instructions
+		if !strings.HasSuffix(mnemonic, "s") {
+			continue
+		}
+		if op, ok := OpString[strings.TrimSuffix(mnemonic, "s")]; ok && op.HasSFlag() {
+			return op, cond, true, true
+		}
+	}
+	return 0, NoCond, false, false
+}
+
+// defineLabel defines the label declared by tok at the current position.
+func (a *assembler) defineLabel(tok token) {
+	label := strings.TrimSuffix(tok.text, labelType)
+	if !isIdent(label) {
+		a.errs = append(a.errs, errorf(tok, "invalid label name %q", label))
+		return
+	}
+	if pos, exist := a.labelPos[label]; exist {
+		a.errs = append(a.errs, errorf(tok, "label %q redefined (previously defined at %v)", label, pos))
+		return
+	}
+	if defs := a.consts[label]; len(defs) > 0 {
+		a.errs = append(a.errs, errorf(tok, "label %q redefines constant (defined at %v)", label, defs[0].name.pos))
+		return
+	}
+	if ext, exist := a.externs[label]; exist {
+		a.errs = append(a.errs, errorf(tok, "label %q redefines imported symbol (declared at %v)", label, ext.pos))
+		return
+	}
+	if a.section == DataSection {
+		// data labels are word addresses
+		a.align(4)
+		a.labels[label] = len(a.data) / 4
+		a.dataLabels[label] = true
+	} else {
+		a.labels[label] = a.pc
+	}
+	a.labelPos[label] = tok.pos
+}
+
+// link evaluates the constants and resolves the operands referring to
+// labels and constants. Every reference to an undefined symbol is
+// reported as an error.
+func (a *assembler) link(instructions []Instruction) {
+	var consts []*constant
+	for _, defs := range a.consts {
+		consts = append(consts, defs...)
+	}
+	sort.Slice(consts, func(i, j int) bool { return consts[i].seq < consts[j].seq })
+	for _, c := range consts {
+		if _, err := a.evalConst(c, true); err != nil && err != errReported {
+			a.errs = append(a.errs, err)
+		}
+	}
+
+	pcs := make([]int, 0, len(a.refs))
+	for pc := range a.refs {
+		pcs = append(pcs, pc)
+	}
+	sort.Ints(pcs)
+
+	for _, pc := range pcs {
+		ref := a.refs[pc]
+		// pseudo instructions expanding in to several instructions
+		// share a single reference.
+		shared := a.refs[pc-1] == ref
+
+		value, relocated, err := a.finalValue(ref, instructions[pc].Op.String(), TextSection, pc, 0)
+		if err != nil {
+			if !shared && err != errReported {
+				a.errs = append(a.errs, err)
 			}
-			ops, err := strconv.Atoi(args[0][1:])
-			if err != nil {
-				// Expect a string. TODO fix this
-				a.setLabels[a.pc] = args[0]
+			continue
+		}
+		instructions[pc].Immediate = true
+		if relocated {
+			// the value is set by the linker
+			continue
+		}
+		switch instructions[pc].Op {
+		case Movw:
+			instructions[pc].Value = value & MaxWideImmediate
+		case Movt:
+			instructions[pc].Value = value >> 16
+		case Svc:
+			if value > MaxWideImmediate {
+				a.errs = append(a.errs, errorf(ref.tok, "%s: syscall number %q (%d) out of range (max %d)", instructions[pc].Op, ref.tok.text, value, MaxWideImmediate))
 			}
-			instr.Dst = RegEntry(ops)
-			instr.Mode = Branching
-		case Ret:
-			instr.Mode = Branching
-		case Ldm, Stm:
-			if len(args) != 2 {
-				return nil, opArgError(op, 2, len(args))
+			instructions[pc].Value = value & MaxWideImmediate
+		case B, Bl:
+			if !isBranchOffset(int64(int32(value))) {
+				a.errs = append(a.errs, errorf(ref.tok, "%s: offset %d of %q out of range (min %d, max %d)", instructions[pc].Op, int32(value), ref.tok.text, MinBranchOffset, MaxBranchOffset))
 			}
-			if !isRegister(args[0]) {
-				return nil, fmt.Errorf("%s: dst must be register: %s", op, args[0])
+			instructions[pc].Value = value
+		default:
+			if instructions[pc].Addr != AddrDirect {
+				if !isTransferOffset(int64(int32(value))) {
+					a.errs = append(a.errs, errorf(ref.tok, "%s: offset %d of %q out of range (min %d, max %d)", instructions[pc].Op, int32(value), ref.tok.text, MinTransferOffset, MaxTransferOffset))
+				}
+				instructions[pc].Value = value
+				break
 			}
-
-			dst, err := strconv.Atoi(args[0][1:])
-			if err != nil {
-				return nil, fmt.Errorf("%s: unexpected error: %v", op, err)
+			if setImmediate(&instructions[pc], value) {
+				break
 			}
-
-			instr.Dst = RegEntry(dst)
-			if isImmediate(args[1]) {
-				ops, err := strconv.Atoi(args[1][1:])
-				if err != nil {
-					return nil, fmt.Errorf("%s: unexepected error: %v", op, err)
-				}
-				instr.Immediate = true
-				instr.Value = uint32(ops)
+			if ref.kind == "label" {
+				a.errs = append(a.errs, errorf(ref.tok, "address %d of label %q cannot be encoded as immediate (use ldr rN =%s)", value, ref.tok.text, ref.tok.text))
 			} else {
-				ops, err := strconv.Atoi(args[1][1:])
-				if err != nil {
-					// Expect a string. TODO fix this
-					a.setLabels[a.pc] = args[1]
-				}
-				instr.Ops1 = RegEntry(ops)
+				a.errs = append(a.errs, errorf(ref.tok, "%s: immediate %q (%d) cannot be encoded (use ldr rN =value)", instructions[pc].Op, ref.tok.text, value))
 			}
-			instr.Mode = DataTransfer
 		}
-		instructions = []Instruction{instr}
 	}
-	return instructions, nil
+	a.linkData()
+
+	if a.entry != nil {
+		value, _, err := a.finalValue(a.entry, ".entry", TextSection, 0, 0)
+		if err != nil && err != errReported {
+			a.errs = append(a.errs, err)
+		}
+		a.entryAddr = value
+	}
 }
 
-// parseOp parses the given op string and returns the opcode
-// conditional value and the S flag.
-func (a assembler) parseOp(strOp string) (Op, Cond, bool) {
-	var (
-		op  Op   // operation
-		con Cond // condition
-	)
-	if len(strOp) > 4 {
-		switch strOp[len(strOp)-4:] {
-		case "gte":
-			con = Gte
-		case "lte":
-			con = Lte
+// finalValue evaluates the reference to a value at the given offset of
+// section. Values relative to a single section or imported symbol are
+// recorded as relocation of the module, in which case the returned value
+// is a placeholder and relocated is set. Values of data are size bytes.
+// Branch targets evaluate to their offset from the branch instruction,
+// the relocation of a branch is its target.
+func (a *assembler) finalValue(ref *reference, name string, section Section, offset, size int) (value uint32, relocated bool, err *Error) {
+	v, err := ref.expr.eval(a.refResolver(ref, true))
+	if err != nil {
+		return 0, false, err
+	}
+	if ref.pcrel {
+		// targets within the module are at a known offset
+		pc := absolute(int64(offset))
+		if a.relocatable {
+			pc = relative(base{section: TextSection}, int64(offset))
 		}
-		if con != NoCond {
-			op = OpString[strOp[:len(strOp)-4]]
+		if diff := v.add(pc, -1); diff.isAbs() {
+			v = diff
 		}
 	}
-	if len(strOp) > 2 {
-		switch strOp[len(strOp)-2:] {
-		case "gt":
-			con = Gt
-		case "lt":
-			con = Lt
-		case "eq":
-			con = Eq
-		case "ne":
-			con = Ne
+	if !v.isAbs() {
+		b, scale, addend, ok := v.relocation()
+		if !ok || ref.pcrel && scale != 1 {
+			return 0, false, errorf(ref.tok, "%s: value of %q is not relocatable", name, ref.tok.text)
 		}
-		if con != NoCond {
-			op = OpString[strOp[:len(strOp)-2]]
+		if addend < math.MinInt32 || addend > math.MaxInt32 {
+			return 0, false, errorf(ref.tok, "%s: offset %d of %q out of range (min %d, max %d)", name, addend, ref.tok.text, math.MinInt32, math.MaxInt32)
 		}
+		a.relocs = append(a.relocs, Reloc{
+			Section: section,
+			Offset:  uint32(offset),
+			Size:    uint8(size),
+			Base:    b.section,
+			Symbol:  b.symbol,
+			Scale:   uint8(scale),
+			Addend:  int32(addend),
+		})
+		return 0, true, nil
 	}
-
-	// yuck clean me up please
-	var sSet bool
-	if con == NoCond {
-		if strOp[len(strOp)-1] == 's' {
-			op = OpString[strOp[:len(strOp)-1]]
-			sSet = true
-		} else {
-			op = OpString[strOp]
-		}
+	value, ok := toValue(v.n)
+	if !ok {
+		return 0, false, errorf(ref.tok, "%s: value %d of %q out of range (min %d, max %d)", name, v.n, ref.tok.text, math.MinInt32, uint32(math.MaxUint32))
 	}
-	return op, con, sSet
+	return value, false, nil
 }
 
-// link links the labels and instructions together.
-func (a assembler) link(instructions []Instruction) {
-	for pc, label := range a.setLabels {
-		instructions[pc].Immediate = true
-		instructions[pc].Value = uint32(a.labels[label])
+// closestLabel returns the defined label or constant closest to name, or
+// an empty string if none is similar enough to be a likely typo.
+func (a *assembler) closestLabel(name string) string {
+	var (
+		match   string
+		maxDist = max(2, len(name)/3) // maximum edit distance considered a typo
+		best    = maxDist + 1
+	)
+	for label := range a.labels {
+		dist := editDistance(name, label)
+		if dist < best || dist == best && label < match {
+			match, best = label, dist
+		}
 	}
-}
-
-// opArgsError is a helper function for to report argument errors.
-func opArgError(op Op, must, count int) error {
-	return fmt.Errorf("[ %s ] requires %d argumenst but got %d", op, must, count)
+	for constant := range a.consts {
+		dist := editDistance(name, constant)
+		if dist < best || dist == best && constant < match {
+			match, best = constant, dist
+		}
+	}
+	return match
 }
@@ -1,6 +1,14 @@
 package asm
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
 
 func ExampleEncodeInstruction() {
 	instr := Instruction{
@@ -30,3 +38,476 @@ func ExampleEncodeInstruction() {
 	// 00000001101000010000111101000001
 	// 00000000101000010001000000000000
 }
+
+func TestAssembleErrors(t *testing.T) {
+	for i, test := range []struct {
+		code string
+		errs []string
+	}{
+		{"foo r0 r1", []string{`1:1: unknown mnemonic "foo"`}},
+		{"mov r99 #1", []string{`1:5: mov: invalid register "r99"`}},
+		{"mov r0", []string{`1:1: mov: not enough arguments: expected 2, got 1`}},
+		{"add r0 r1 r2 r3", []string{`1:14: add: too many arguments: expected 3, got 4`}},
+		{"mov r0 #1abc", []string{`1:8: mov: invalid immediate "#1abc"`}},
+		{"add r0 #1 r2", []string{`1:8: add: expected register, got "#1"`}},
+		{"adds r0 r0 #257", []string{`1:12: add: immediate "#257" cannot be encoded (use ldr rN =value)`}},
+		{"movw r0 #65536", []string{`1:9: movw: immediate "#65536" out of range (max 65535)`}},
+		{"ldr r0 =foo", []string{`1:9: undefined label "foo"`}},
+		{"svc #65536", []string{`1:5: svc: syscall number "#65536" out of range (max 65535)`}},
+		{"svc #N\n.equ N 0x10000", []string{`1:5: svc: syscall number "#N" (65536) out of range (max 65535)`}},
+		{"svc r0", []string{`1:5: svc: expected immediate, got "r0"`}},
+		{"ldr pc =main\nmain: ret", []string{`1:8: mov: cannot load "=main" in to pc in one instruction (load it in to rN and use bx rN)`}},
+		{"mov pc #0x12345", []string{`1:8: mov: cannot load "#0x12345" in to pc in one instruction (load it in to rN and use bx rN)`}},
+		{"mov r0 #0x100000000", []string{`1:8: mov: immediate "#0x100000000" out of range (min -2147483648, max 4294967295)`}},
+		{"mov r0 #-2147483649", []string{`1:8: mov: immediate "#-2147483649" out of range (min -2147483648, max 4294967295)`}},
+		{"mov r0 #0b102", []string{`1:8: mov: invalid immediate "#0b102"`}},
+		{"mov r0 #'AB'", []string{`1:8: mov: invalid immediate "#'AB'"`}},
+		{"cmp r0 #-1", []string{`1:8: cmp: immediate "#-1" cannot be encoded (use ldr rN =value)`}},
+		{"movw r0 #-1", []string{`1:9: movw: immediate "#-1" out of range (max 65535)`}},
+		{"push {}", []string{`1:6: push: empty register list`}},
+		{"push {r0, r1", []string{`1:6: push: unterminated register list "{r0, r1"`}},
+		{"push {r0, r0}", []string{`1:6: push: duplicate register r0 in list "{r0, r0}"`}},
+		{"pop {r4-r2}", []string{`1:5: pop: invalid register range "r4-r2"`}},
+		{"push {r12-lr}", []string{`1:6: push: stack pointer not allowed in register list`}},
+		{"pop sp", []string{`1:5: pop: stack pointer not allowed in register list`}},
+		{"push {r0, r16}", []string{`1:6: push: invalid register "r16"`}},
+		{"ldm r0 [r1, #512]", []string{`1:8: ldm: offset "#512" out of range (min -512, max 511)`}},
+		{"ldm r0 [r1, #OFF]\n.equ OFF -513", []string{`1:8: ldm: offset -513 of "#OFF" out of range (min -512, max 511)`}},
+		{"stm r0 [r1, #4", []string{`1:8: stm: unterminated address "[r1, #4"`}},
+		{"stm r0 [r1, #4, #4]", []string{`1:8: stm: invalid address "[r1, #4, #4]": expected [rN] or [rN, offset]`}},
+		{"stm r0 [r1]!", []string{`1:8: stm: write back of "[r1]!" requires an offset`}},
+		{"ldrb r0 [r1, #4], #4", []string{`1:9: ldrb: post-indexed address "[r1, #4]" must be [rN]`}},
+		{"ldm r0 [r1], foo", []string{`1:14: ldm: expected register or offset, got "foo"`}},
+		{"ldm r0 [r16]", []string{`1:8: ldm: invalid register "r16"`}},
+		{"ldm r0 r1 #4", []string{`1:11: ldm: too many arguments: expected 2, got 3`}},
+		{".entry main\nmain:\n.entry main", []string{`3:8: .entry: entry point redefined (previously defined at 1:8)`}},
+		{".entry mian\nmain:", []string{`1:8: undefined label "mian" (did you mean "main"?)`}},
+		{"rets", []string{`1:1: unknown mnemonic "rets"`}},
+		{"mov r15 mian\nmain:\n\tcall mian\n\tcall foo", []string{
+			`1:9: undefined label "mian" (did you mean "main"?)`,
+			`3:7: undefined label "mian" (did you mean "main"?)`,
+			`4:7: undefined label "foo"`,
+		}},
+		{"\tmov r0 #1\n\tb end\n\tmov r99 #1\n\tcall foo\n\trets", []string{ // parse and link errors in source order
+			`2:4: undefined label "end"`,
+			`3:6: mov: invalid register "r99"`,
+			`4:7: undefined label "foo"`,
+			`5:2: unknown mnemonic "rets"`,
+		}},
+		{"main:\n\tmov r0 #1\nmain: ret", []string{`3:1: label "main" redefined (previously defined at 1:1)`}},
+		{"1abc:", []string{`1:1: invalid label name "1abc"`}},
+		{".equ SIZE 4\n.equ SIZE 8", []string{`2:6: constant "SIZE" redefined (previously defined at 1:6)`}},
+		{".set SIZE 4\n.equ SIZE 8", []string{`2:6: constant "SIZE" redefined (previously defined at 1:6)`}},
+		{"main:\n.equ main 1", []string{`2:6: constant "main" redefines label (defined at 1:1)`}},
+		{".equ main 1\nmain:", []string{`2:1: label "main" redefines constant (defined at 1:6)`}},
+		{".equ A B\n.equ B A", []string{`1:6: constant "A" is defined in terms of itself`}},
+		{".equ SIZE 4\nmov r0 #(SIZ*2)", []string{`2:10: undefined symbol "SIZ" (did you mean "SIZE"?)`}},
+		{".equ X (1/0)\nmov r0 #X", []string{`1:10: division by zero`}},
+		{"mov r0 #(1+2", []string{`1:13: mov: invalid expression "#(1+2": missing closing parenthesis`}},
+		{"mov r0 #1+*2", []string{`1:11: mov: invalid expression "#1+*2": unexpected "*"`}},
+		{".equ BIG 0x10000\nadd r0 r0 #BIG+1", []string{`2:11: add: immediate "#BIG+1" cannot be encoded (use ldr rN =value)`}},
+		{"add r0 r0 #N\n.equ N 0x10001", []string{`1:11: add: immediate "#N" (65537) cannot be encoded (use ldr rN =value)`}},
+		{"mov r0 #(1<<31)*4", []string{`1:8: mov: immediate "#(1<<31)*4" out of range (min -2147483648, max 4294967295)`}},
+		{".foo 1", []string{`1:1: unknown directive ".foo"`}},
+		{".equ X", []string{`1:1: .equ: not enough arguments: expected 2, got 1`}},
+		{".word 1", []string{`1:1: .word: not in data section (use .data)`}},
+		{".data\nmov r0 #1", []string{`2:1: instruction "mov" in data section`}},
+		{".data\n.byte 256, -129", []string{`2:7: .byte: value "256" out of range (min -128, max 255)`}},
+		{".data\n.byte x\n.equ x 300", []string{`2:7: .byte: value "x" out of range (min -128, max 255)`}},
+		{".data\n.word undef", []string{`2:7: undefined symbol "undef"`}},
+		{"b #0x80000", []string{`1:3: b: offset "#0x80000" out of range (min -524288, max 524287)`}},
+		{"b r0", []string{`1:3: b: expected label or offset, got "r0"`}},
+		{".extern puts", []string{`1:1: .extern: symbols can only be imported by modules (use AssembleModule)`}},
+		{".global main, mian\nmain:", []string{`1:15: global symbol "mian" is not defined`}},
+		{".data\n.string hi", []string{`2:9: .string: invalid string "hi"`}},
+		{".data\n.space N\n.equ N 4", []string{`2:8: .space: "N" is not a constant defined before its use`}},
+		{".data\n.align 3", []string{`2:8: .align: alignment "3" is not a power of 2`}},
+		{".data\n.space 8\n.org 4", []string{`3:6: .org: cannot move backwards from offset 8 to 4`}},
+		{".data\n.space 0x2000000", []string{`2:8: .space: data section exceeds 16777216 bytes`}},
+		{".macro bad\n\tmov r99 #1\n.endm\n\tbad", []string{`2:6: mov: invalid register "r99" (in macro "bad" invoked at 4:2)`}},
+		{".macro inner x\n\tmov r0 \\x\n.endm\n.macro outer\n\tinner #257z\n.endm\nouter", []string{
+			`2:9: mov: invalid immediate "#257z" (in macro "inner" invoked at 5:2, in macro "outer" invoked at 7:1)`,
+		}},
+		{".macro rec\n\trec\n.endm\nrec", []string{
+			`2:2: macro "rec": expansion too deep (limit 64) (in macro "rec" invoked at 2:2, in macro "rec" invoked at 2:2, ..., in macro "rec" invoked at 4:1)`,
+		}},
+		{".macro m\nl:\n.endm\nm\nm", []string{`2:1: label "l" redefined (previously defined at 2:1) (in macro "m" invoked at 5:1)`}},
+		{".macro m a b\n.endm\nm r0 r1 r2", []string{`3:9: macro "m": too many arguments: expected 2, got 3`}},
+		{".macro m a b\n.endm\nm r0", []string{`3:1: macro "m": missing argument "b"`}},
+		{".macro m\n\tmov r0 #1", []string{`1:8: macro "m": missing .endm`}},
+		{".endm", []string{`1:1: .endm without .macro`}},
+		{".macro add\n.endm", []string{`1:8: macro "add" redefines instruction`}},
+		{".macro m\n.endm\n.macro m\n.endm", []string{`3:8: macro "m" redefined (previously defined at 1:8)`}},
+		{".macro m a a\n.endm", []string{`1:12: macro "m": duplicate parameter "a"`}},
+		{".macro m\n.macro n\n.endm\n.endm", []string{`2:1: macro "m": nested macro definition`, `4:1: .endm without .macro`}},
+		{"  foo\nmov r0 #1 ; comment\n\tbar r0, r1", []string{
+			`1:3: unknown mnemonic "foo"`,
+			`3:2: unknown mnemonic "bar"`,
+		}},
+	} {
+		_, err := Assemble(test.code)
+		errs, ok := err.(ErrorList)
+		if !ok {
+			t.Errorf("%d failed: expected ErrorList, got %v", i, err)
+			continue
+		}
+		if len(errs) != len(test.errs) {
+			t.Errorf("%d failed: expected %d errors, got %d: %v", i, len(test.errs), len(errs), errs)
+			continue
+		}
+		for j, err := range errs {
+			if err.Error() != test.errs[j] {
+				t.Errorf("%d failed: expected error %q, got %q", i, test.errs[j], err)
+			}
+		}
+	}
+}
+
+func TestAssembleData(t *testing.T) {
+	obj, symbols, err := AssembleObject(`
+.equ	N 3
+	ldr	r0 =table
+	stop
+.data
+	.byte	1, -1, 'A'
+table:	.word	N, end, -2
+	.string	"hi", "a\tb"
+	.align
+	.space	2, 0xff
+	.org	32
+end:
+	.byte	table*4
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		1, 0xff, 'A', 0, // aligned table label
+		0, 0, 0, 3, 0, 0, 0, 8, 0xff, 0xff, 0xff, 0xfe,
+		'h', 'i', 0, 'a', '\t', 'b', 0, 0,
+		0xff, 0xff, 0, 0, 0, 0, 0, 0,
+		4,
+	}
+	if !bytes.Equal(obj.Data, want) {
+		t.Errorf("data mismatch:\nwant %v\ngot  %v", want, obj.Data)
+	}
+	if _, ok := symbols["table"]; ok {
+		t.Error("expected data labels not to be part of the symbol table")
+	}
+	if len(obj.Code) != 12 {
+		t.Errorf("expected 3 instructions, got %x", obj.Code)
+	}
+
+	if _, err := Assemble(".data\n.word 1"); err == nil {
+		t.Error("expected Assemble to reject programs with a data section")
+	}
+
+	// byte and halfword loads and stores take the byte address of data
+	// labels, whether they're defined before or after the instruction
+	for _, code := range []string{
+		".data\n.space 8\nb: .byte 1\n.text\n\tldrb r0 b\n\tldrh r1 #b+1\n\tldm r2 b",
+		"\tldrb r0 b\n\tldrh r1 #b+1\n\tldm r2 b\n.data\n.space 8\nb: .byte 1",
+	} {
+		obj, _, err := AssembleObject(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pc, exp := range []uint32{8, 9, 2} {
+			if instr := DecodeInstruction(binary.BigEndian.Uint32(obj.Code[pc*4:])); instr.Value != exp {
+				t.Errorf("%q: expected value %d at %d, got %d", code, exp, pc, instr.Value)
+			}
+		}
+	}
+}
+
+func TestAssembleFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.asm":        {Data: []byte(".include \"lib/math.asm\"\n\tmov r0 #2\n\tcall double\n\tstop")},
+		"lib/math.asm":    {Data: []byte(".include \"const.asm\"\ndouble:\n\tmul r0 r0 #FACTOR\n\tret")},
+		"lib/const.asm":   {Data: []byte(".equ FACTOR 2")},
+		"inc/util.asm":    {Data: []byte("util: ret")},
+		"search.asm":      {Data: []byte(".include \"util.asm\"")},
+		"cycle/a.asm":     {Data: []byte(".include \"b.asm\"")},
+		"cycle/b.asm":     {Data: []byte("\tmov r0 #1\n.include \"a.asm\"")},
+		"errors/main.asm": {Data: []byte("\tmov r0 #1\n.include \"bad.asm\"\n.include \"missing.asm\"")},
+		"errors/bad.asm":  {Data: []byte("\n\tmov r99 #1")},
+		"macros/main.asm": {Data: []byte(".include \"m.asm\"\n\tbad")},
+		"macros/m.asm":    {Data: []byte(".macro bad\n\tfoo\n.endm")},
+		"paths/main.asm":  {Data: []byte(".include \"lib/const.asm\"\n\tmov r0 #FACTOR")},
+	}
+
+	obj, symbols, err := AssembleFS(fsys, "main.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := symbols["double"]; !ok || addr != 0 || len(obj.Code) != 20 {
+		t.Errorf("unexpected result: double=%d (%v) code=%x", addr, ok, obj.Code)
+	}
+	if _, _, err := AssembleFS(fsys, "search.asm"); err == nil {
+		t.Error("expected error including file outside the include path")
+	}
+	if _, _, err := AssembleFS(fsys, "search.asm", "inc"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := AssembleFS(fsys, "paths/main.asm", "."); err != nil {
+		t.Error(err)
+	}
+
+	for i, test := range []struct {
+		file string
+		errs []string
+	}{
+		{"cycle/a.asm", []string{`cycle/b.asm:2:10: .include: include cycle: cycle/a.asm -> cycle/b.asm -> cycle/a.asm`}},
+		{"errors/main.asm", []string{
+			`errors/bad.asm:2:6: mov: invalid register "r99"`,
+			`errors/main.asm:3:10: .include: file "missing.asm" not found`,
+		}},
+		{"macros/main.asm", []string{`macros/m.asm:2:2: unknown mnemonic "foo" (in macro "bad" invoked at macros/main.asm:2:2)`}},
+	} {
+		_, _, err := AssembleFS(fsys, test.file)
+		errs, ok := err.(ErrorList)
+		if !ok || len(errs) != len(test.errs) {
+			t.Errorf("%d failed: expected %d errors, got %v", i, len(test.errs), err)
+			continue
+		}
+		for j, err := range errs {
+			if err.Error() != test.errs[j] {
+				t.Errorf("%d failed: expected error %q, got %q", i, test.errs[j], err)
+			}
+		}
+	}
+
+	if _, err := Assemble(".include \"main.asm\""); err == nil {
+		t.Error("expected error including a file without a file system")
+	}
+}
+
+func TestLink(t *testing.T) {
+	main, err := AssembleModule(`
+.extern double, table
+.global main
+main:
+	ldr	r1 =table
+	ldm	r0 r1
+	call	double
+	stop
+.data
+	.word	table+1, main
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := AssembleModule(`
+.global double, table
+double:
+	mul	r0 r0 #2
+	ret
+.data
+	.byte	7
+table:	.word	21, double, table*4
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// modules survive a round trip through the module file format
+	data, err := lib.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsModule(data) || IsObject(data) {
+		t.Fatal("expected encoded module to be recognised as module")
+	}
+	lib = new(Module)
+	if err := lib.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(Module).UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("expected error decoding truncated module")
+	}
+	for _, version := range []string{"\x00\x01", "\x00\x02", "\x00\x03", "\x00\x04"} {
+		if err := new(Module).UnmarshalBinary(append([]byte("TVMR"+version), data[6:]...)); err == nil || !strings.Contains(err.Error(), "older assembler") {
+			t.Errorf("expected module version %x to be rejected, got %v", version, err)
+		}
+	}
+
+	obj, symbols, err := Link(main, lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 0, 4, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 21, 0, 0, 0, 5, 0, 0, 0, 12}
+	if !bytes.Equal(obj.Data, want) {
+		t.Errorf("data mismatch:\nwant %v\ngot  %v", want, obj.Data)
+	}
+	if len(symbols) != 2 || symbols["main"] != 0 || symbols["double"] != 5 {
+		t.Errorf("unexpected symbol table %v", symbols)
+	}
+	// calls are relative to the call instruction
+	for pc, value := range map[int]uint32{0: 3, 1: 0, 3: 2} {
+		instr := DecodeInstruction(binary.BigEndian.Uint32(obj.Code[pc*4:]))
+		if instr.Value != value {
+			t.Errorf("instruction %d (%v): expected value %d, got %d", pc, instr.Op, value, instr.Value)
+		}
+	}
+
+	for i, test := range []struct {
+		code []string
+		err  string
+	}{
+		{[]string{".extern foo, bar\n\tcall foo\n\tmov r0 bar\n\tmov r1 bar"}, `undefined symbol "foo" (referenced by module 0)` + "\n" + `undefined symbol "bar" (referenced by module 0)`},
+		{[]string{".global f\nf: ret", ".global f\n\tmov r0 #1\nf: ret"}, `duplicate symbol "f" (defined by module 0 and module 1)`},
+		{[]string{".extern f\n\tmov r0 f", ".global f\n.data\n.space 0x1004\nf: .word 1"}, `module 0: mov at 0: relocated value 1025 cannot be encoded as immediate (use ldr rN =f)`},
+		{[]string{".extern f\n.data\n.byte f", ".global f\n.data\n.space 0x1000\nf: .word 1"}, `module 0: relocated value 1025 of data at 0 out of range (min -128, max 255)`},
+	} {
+		var modules []*Module
+		for _, code := range test.code {
+			m, err := AssembleModule(code)
+			if err != nil {
+				t.Fatalf("%d failed: %v", i, err)
+			}
+			modules = append(modules, m)
+		}
+		if _, _, err := Link(modules...); err == nil || err.Error() != test.err {
+			t.Errorf("%d failed: expected error %q, got %v", i, test.err, err)
+		}
+	}
+
+	for i, test := range []struct {
+		code string
+		err  string
+	}{
+		{".extern a, b\n.data\n.word a+b", `3:7: .word: value of "a+b" is not relocatable`},
+		{"l: ret\n.data\n.word l*2", `3:7: .word: value of "l*2" is not relocatable`},
+		{"\tldrb r0 #b*2\n.data\nb: .word 1", `1:10: ldrb: value of "#b*2" is not relocatable`},
+		{"\tb l*4\nl: ret", `1:4: b: value of "l*4" is not relocatable`},
+		{".extern b\n\tldrb r0 b", `2:10: byte address of imported symbol "b" is unknown (use ldr rN =b*4 if it is a data label)`},
+		{"l: mov r0 #l<<1", `1:13: operator "<<" not allowed on relocatable address`},
+		{".extern l\nl: ret", `2:1: label "l" redefines imported symbol (declared at 1:9)`},
+		{".entry main\nmain: ret", `1:1: .entry: modules have no entry point (use tinyvm link -entry)`},
+	} {
+		if _, err := AssembleModule(test.code); err == nil || err.Error() != test.err {
+			t.Errorf("%d failed: expected error %q, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	for i, test := range []struct {
+		text  string
+		value uint32
+		err   error
+	}{
+		{"10", 10, nil},
+		{"010", 10, nil},
+		{"0xff", 0xff, nil},
+		{"0XFF", 0xff, nil},
+		{"0b1010", 10, nil},
+		{"'A'", 65, nil},
+		{"'\\n'", '\n', nil},
+		{"' '", ' ', nil},
+		{"-1", 0xffffffff, nil},
+		{"-0x10", 0xfffffff0, nil},
+		{"-2147483648", 0x80000000, nil},
+		{"4294967295", 0xffffffff, nil},
+		{"4294967296", 0, strconv.ErrRange},
+		{"-2147483649", 0, strconv.ErrRange},
+		{"", 0, strconv.ErrSyntax},
+		{"0x", 0, strconv.ErrSyntax},
+		{"--1", 0, strconv.ErrSyntax},
+		{"+1", 0, strconv.ErrSyntax},
+		{"1_000", 0, strconv.ErrSyntax},
+		{"''", 0, strconv.ErrSyntax},
+	} {
+		value, err := parseNumber(test.text)
+		if err != test.err {
+			t.Errorf("%d failed: expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if value != test.value {
+			t.Errorf("%d failed: expected %#x, got %#x", i, test.value, value)
+		}
+	}
+}
+
+func TestParseOp(t *testing.T) {
+	for i, test := range []struct {
+		mnemonic string
+		op       Op
+		cond     Cond
+		s        bool
+	}{
+		{"mov", Mov, NoCond, false},
+		{"movs", Mov, NoCond, true},
+		{"moveq", Mov, Eq, false},
+		{"subseq", Sub, Eq, true},
+		{"movgte", Mov, Gte, false},
+		{"lsls", Lsl, NoCond, true},
+		{"ldr", Ldm, NoCond, false},
+		{"strne", Stm, Ne, false},
+		{"halt", Stop, NoCond, false},
+		{"movhs", Mov, Hs, false},
+		{"movcs", Mov, Hs, false},
+		{"movge", Mov, Gte, false},
+		{"lslls", Lsl, Ls, false},
+		{"subsvs", Sub, Vs, true},
+		{"cmpal", Cmp, Al, false},
+	} {
+		op, cond, s, ok := parseOp(test.mnemonic)
+		if !ok {
+			t.Errorf("%d failed: %q not recognised", i, test.mnemonic)
+			continue
+		}
+		if op != test.op || cond != test.cond || s != test.s {
+			t.Errorf("%d failed: expected %v %v %v, got %v %v %v", i, test.op, test.cond, test.s, op, cond, s)
+		}
+	}
+}
+
+func TestObject(t *testing.T) {
+	code, err := Assemble("mov r0 #1\nmain:\n\tmov r1 #2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := (&Object{Entry: 1, Code: code, Data: []byte{1, 2, 3}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsObject(data) {
+		t.Fatal("expected encoded object to be recognised as object")
+	}
+	if IsObject(code) {
+		t.Error("expected raw code not to be recognised as object")
+	}
+
+	var obj Object
+	if err := obj.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if obj.Entry != 1 || !bytes.Equal(obj.Code, code) || !bytes.Equal(obj.Data, []byte{1, 2, 3}) {
+		t.Errorf("object mismatch: entry %d code %x data %x", obj.Entry, obj.Code, obj.Data)
+	}
+
+	// objects built for an older instruction set must be rejected
+	for _, old := range [][]byte{
+		append([]byte("TVMO\x00\x01\x00\x00\x00\x00\x00\x01\x00\x00\x00\x08"), code...),
+		append([]byte("TVMO\x00\x02"), data[6:]...),
+		append([]byte("TVMO\x00\x03"), data[6:]...),
+		append([]byte("TVMO\x00\x04"), data[6:]...),
+	} {
+		if err := obj.UnmarshalBinary(old); err == nil || !strings.Contains(err.Error(), "older instruction set") {
+			t.Errorf("expected old object to be rejected, got %v", err)
+		}
+	}
+
+	// corrupt objects must be rejected
+	for i, data := range [][]byte{
+		data[:10],
+		data[:len(data)-4],
+		append([]byte("TVMO\x00\x09"), data[6:]...),
+		data[:18],
+	} {
+		if err := new(Object).UnmarshalBinary(data); err == nil {
+			t.Errorf("%d failed: expected error", i)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package asm
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 const (
@@ -14,7 +15,41 @@ const (
 	DstPos           = 16
 	Ops1Pos          = 12
 	Ops2Pos          = 8
+	Ops3Pos          = 4
 	ImmediatePos     = 0
+
+	// IndexFlagPos marks the indexed addressing modes of data transfer
+	// instructions, which don't have an S flag, and IndexPos is the
+	// position of the two bit addressing mode.
+	IndexFlagPos = SFlagPos
+	IndexPos     = 10
+
+	// MaxWideImmediate is the largest immediate value of movw and movt,
+	// which encode a 16 bit immediate in bits 15 to 0.
+	MaxWideImmediate = 0xffff
+
+	// MinBranchOffset and MaxBranchOffset are the bounds of the offset
+	// of b and bl, which encode a signed 20 bit offset in bits 19 to 0.
+	MinBranchOffset = -1 << 19
+	MaxBranchOffset = 1<<19 - 1
+
+	// MinTransferOffset and MaxTransferOffset are the bounds of the
+	// immediate offset of the indexed addressing modes, which encode a
+	// signed 10 bit offset in bits 9 to 0.
+	MinTransferOffset = -1 << 9
+	MaxTransferOffset = 1<<9 - 1
+)
+
+// AddrMode is the addressing mode of a data transfer instruction. The
+// offset is either an immediate or the register Ops2 and is added to the
+// base register Ops1.
+type AddrMode byte
+
+const (
+	AddrDirect    AddrMode = iota // address in Ops1 or immediate (ldm r0 r1, ldm r0 #4)
+	AddrOffset                    // base plus offset ([r1, #4])
+	AddrPreIndex                  // base plus offset, written back to the base ([r1, #4]!)
+	AddrPostIndex                 // base, which is incremented by the offset afterwards ([r1], #4)
 )
 
 type Instruction struct {
@@ -27,6 +62,9 @@ type Instruction struct {
 	Dst  RegEntry
 	Ops1 RegEntry
 	Ops2 RegEntry
+	Ops3 RegEntry // accumulator of mla
+	Regs uint16   // register list of push and pop (bit n is rN)
+	Addr AddrMode // addressing mode of data transfer instructions
 
 	Immediate bool
 	Value     uint32
@@ -36,12 +74,43 @@ func EncodeInstruction(instr Instruction) (uint32, error) {
 	var encoded uint32
 	encoded |= (uint32(instr.Cond) << CondPos)
 	encoded |= (uint32(instr.Mode) << ModePos)
-	encoded |= (uint32(instr.Op) << InstrPos)
+	encoded |= (uint32(instr.Op&0xf) << InstrPos)
 	encoded |= (uint32(instr.Dst) << DstPos)
-	encoded |= (uint32(instr.Ops1) << Ops1Pos)
 	if instr.S {
 		encoded |= 1 << SFlagPos
 	}
+	if isWide(instr.Op) {
+		if !instr.Immediate || instr.Value > MaxWideImmediate {
+			return 0, fmt.Errorf("instruction encoder err: %s requires a 16 bit immediate (value=%d)", instr.Op, instr.Value)
+		}
+		return encoded | 1<<ImmediateFlagPos | instr.Value, nil
+	}
+	if isBranch(instr.Op) {
+		if !instr.Immediate || !isBranchOffset(int64(int32(instr.Value))) {
+			return 0, fmt.Errorf("instruction encoder err: %s requires a 20 bit signed offset (offset=%d)", instr.Op, int32(instr.Value))
+		}
+		return encoded | 1<<ImmediateFlagPos | instr.Value&(1<<20-1), nil
+	}
+	if isRegList(instr.Op) {
+		if instr.Immediate || instr.Regs == 0 {
+			return 0, fmt.Errorf("instruction encoder err: %s requires a non-empty register list", instr.Op)
+		}
+		return encoded | uint32(instr.Regs), nil
+	}
+	if instr.Addr != AddrDirect {
+		if !isTransfer(instr.Op) || instr.Addr > AddrPostIndex {
+			return 0, fmt.Errorf("instruction encoder err: invalid addressing mode %d of %s", instr.Addr, instr.Op)
+		}
+		encoded |= 1<<IndexFlagPos | uint32(instr.Addr-1)<<IndexPos | uint32(instr.Ops1)<<Ops1Pos
+		if !instr.Immediate {
+			return encoded | uint32(instr.Ops2), nil
+		}
+		if !isTransferOffset(int64(int32(instr.Value))) {
+			return 0, fmt.Errorf("instruction encoder err: %s requires a 10 bit signed offset (offset=%d)", instr.Op, int32(instr.Value))
+		}
+		return encoded | 1<<ImmediateFlagPos | instr.Value&(1<<IndexPos-1), nil
+	}
+	encoded |= (uint32(instr.Ops1) << Ops1Pos)
 	if instr.Immediate {
 		encoded |= 1 << ImmediateFlagPos
 		encodedValue, err := encodeImmediate(instr.Value)
@@ -51,6 +120,7 @@ func EncodeInstruction(instr Instruction) (uint32, error) {
 		encoded |= encodedValue
 	} else {
 		encoded |= (uint32(instr.Ops2) << Ops2Pos)
+		encoded |= (uint32(instr.Ops3) << Ops3Pos)
 	}
 	return encoded, nil
 }
@@ -60,21 +130,181 @@ func DecodeInstruction(instruction uint32) Instruction {
 	instr.Raw = instruction
 	instr.Cond = Cond(getBits(instruction, CondPos, CondPos+3))
 	instr.Mode = Mode(getBits(instruction, ModePos, ModePos+1))
-	instr.Op = Op(getBits(instruction, InstrPos, InstrPos+3))
+	instr.Op = Op(uint32(instr.Mode)<<4 | getBits(instruction, InstrPos, InstrPos+3))
 	instr.Dst = RegEntry(getBits(instruction, DstPos, DstPos+3))
-	instr.Ops1 = RegEntry(getBits(instruction, Ops1Pos, Ops1Pos+3))
 	instr.S = isSet(instruction, SFlagPos)
+	if isWide(instr.Op) {
+		instr.Immediate = isSet(instruction, ImmediateFlagPos)
+		instr.Value = getBits(instruction, 0, 15)
+		return instr
+	}
+	if isBranch(instr.Op) {
+		// sign extend the offset
+		instr.Immediate = isSet(instruction, ImmediateFlagPos)
+		instr.Value = uint32(int32(instruction<<12) >> 12)
+		return instr
+	}
+	if isRegList(instr.Op) {
+		instr.Immediate = isSet(instruction, ImmediateFlagPos)
+		instr.Regs = uint16(getBits(instruction, 0, 15))
+		return instr
+	}
+	if isTransfer(instr.Op) && instr.S {
+		instr.S = false
+		instr.Addr = AddrMode(getBits(instruction, IndexPos, IndexPos+1) + 1)
+		instr.Ops1 = RegEntry(getBits(instruction, Ops1Pos, Ops1Pos+3))
+		if instr.Immediate = isSet(instruction, ImmediateFlagPos); instr.Immediate {
+			// sign extend the offset
+			instr.Value = uint32(int32(instruction<<22) >> 22)
+		} else {
+			instr.Ops2 = RegEntry(getBits(instruction, 0, 3))
+		}
+		return instr
+	}
+	instr.Ops1 = RegEntry(getBits(instruction, Ops1Pos, Ops1Pos+3))
 
 	if isSet(instruction, ImmediateFlagPos) {
 		instr.Immediate = true
 		instr.Value = decodeImmediate(getBits(instruction, 0, 11))
 	} else {
 		instr.Ops2 = RegEntry(getBits(instruction, Ops2Pos, Ops2Pos+3))
+		instr.Ops3 = RegEntry(getBits(instruction, Ops3Pos, Ops3Pos+3))
 	}
 
 	return instr
 }
 
+// Mnemonic returns the mnemonic of the instruction including the
+// S flag and condition suffix (e.g. subseq).
+func (instr Instruction) Mnemonic() string {
+	mnemonic := instr.Op.String()
+	if instr.S {
+		mnemonic += "s"
+	}
+	if instr.Cond != NoCond {
+		mnemonic += instr.Cond.String()
+	}
+	return mnemonic
+}
+
+// String returns the instruction in assembly form.
+func (instr Instruction) String() string {
+	operand := func(reg RegEntry) string {
+		if instr.Immediate {
+			return fmt.Sprintf("#%d", instr.Value)
+		}
+		return reg.String()
+	}
+
+	var args []string
+	switch instr.Op {
+	case Mov, Cmp, Movw, Movt:
+		args = []string{instr.Dst.String(), operand(instr.Ops1)}
+	case Ldm, Stm, Ldrb, Strb, Ldrh, Strh:
+		offset := instr.Ops2.String()
+		if instr.Immediate {
+			offset = fmt.Sprintf("#%d", int32(instr.Value))
+		}
+		switch instr.Addr {
+		case AddrOffset:
+			args = []string{instr.Dst.String(), fmt.Sprintf("[%s, %s]", instr.Ops1, offset)}
+		case AddrPreIndex:
+			args = []string{instr.Dst.String(), fmt.Sprintf("[%s, %s]!", instr.Ops1, offset)}
+		case AddrPostIndex:
+			args = []string{instr.Dst.String(), fmt.Sprintf("[%s],", instr.Ops1), offset}
+		default:
+			args = []string{instr.Dst.String(), operand(instr.Ops1)}
+		}
+	case Svc:
+		args = []string{operand(instr.Ops1)}
+	case B, Bl:
+		args = []string{fmt.Sprintf("#%d", int32(instr.Value))}
+	case Blx, Bx:
+		args = []string{instr.Ops1.String()}
+	case Push, Pop:
+		args = []string{regList(instr.Regs)}
+	case Stop:
+		if !instr.Immediate || instr.Value != 0 {
+			args = []string{operand(instr.Ops1)}
+		}
+	case Mla:
+		args = []string{instr.Dst.String(), instr.Ops1.String(), instr.Ops2.String(), instr.Ops3.String()}
+	case Ret:
+	default:
+		args = []string{instr.Dst.String(), instr.Ops1.String(), operand(instr.Ops2)}
+	}
+	if len(args) == 0 {
+		return instr.Mnemonic()
+	}
+	return instr.Mnemonic() + " " + strings.Join(args, " ")
+}
+
+// isWide returns whether the op encodes a 16 bit immediate.
+func isWide(op Op) bool {
+	return op == Movw || op == Movt || op == Svc
+}
+
+// isRegList returns whether the op encodes a register list in bits 15 to 0.
+func isRegList(op Op) bool {
+	return op == Push || op == Pop
+}
+
+// regList returns the register list of push and pop in assembly form, in
+// which runs of three or more registers are written as range (e.g.
+// {r4-r7, r14}).
+func regList(regs uint16) string {
+	var list []string
+	for r := 0; r < MaxRegister; r++ {
+		if regs&(1<<r) == 0 {
+			continue
+		}
+		end := r
+		for end+1 < MaxRegister && regs&(1<<(end+1)) != 0 {
+			end++
+		}
+		if end-r < 2 {
+			list = append(list, RegEntry(r).String())
+			continue
+		}
+		list = append(list, RegEntry(r).String()+"-"+RegEntry(end).String())
+		r = end
+	}
+	return "{" + strings.Join(list, ", ") + "}"
+}
+
+// isTransfer returns whether the op is a load or store, which supports the
+// addressing modes.
+func isTransfer(op Op) bool {
+	switch op {
+	case Ldm, Stm, Ldrb, Strb, Ldrh, Strh:
+		return true
+	}
+	return false
+}
+
+// isByteTransfer returns whether op loads or stores bytes or halfwords,
+// which are addressed by byte rather than word address.
+func isByteTransfer(op Op) bool {
+	return op >= Ldrb && op <= Strh
+}
+
+// isTransferOffset returns whether offset can be encoded as immediate offset
+// of the indexed addressing modes.
+func isTransferOffset(offset int64) bool {
+	return offset >= MinTransferOffset && offset <= MaxTransferOffset
+}
+
+// isBranch returns whether op branches to an offset relative to itself.
+func isBranch(op Op) bool {
+	return op == B || op == Bl
+}
+
+// isBranchOffset returns whether offset can be encoded as offset of b and
+// bl.
+func isBranchOffset(offset int64) bool {
+	return offset >= MinBranchOffset && offset <= MaxBranchOffset
+}
+
 func isSet(n uint32, bit uint32) bool {
 	return (n >> bit & 1) == 1
 }
@@ -0,0 +1,557 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const directivePrefix = "." // assembler directive prefix
+
+// Section is a section of an assembled program.
+type Section uint8
+
+const (
+	TextSection  Section = iota // code
+	DataSection                 // initialised data loaded in to memory
+	UndefSection                // symbols imported from other modules
+)
+
+func (s Section) String() string {
+	switch s {
+	case TextSection:
+		return "text"
+	case DataSection:
+		return "data"
+	case UndefSection:
+		return "undef"
+	}
+	return fmt.Sprintf("section(%d)", uint8(s))
+}
+
+// dataRef is a data value which is resolved at link time.
+type dataRef struct {
+	dir  string // directive emitting the value
+	ref  *reference
+	size int // size of the value in bytes
+}
+
+// isDirective returns whether s is an assembler directive (e.g. .equ)
+func isDirective(s string) bool {
+	return strings.HasPrefix(s, directivePrefix)
+}
+
+// constant is a symbolic constant defined by .equ or .set.
+type constant struct {
+	name  token // name token of the definition
+	expr  expr  // value of the constant
+	seq   int   // number of constant definitions preceding this one
+	set   bool  // defined by .set and may be redefined
+	state evalState
+	value exprValue
+}
+
+// evalState is the evaluation state of a constant.
+type evalState int
+
+const (
+	unevaluated evalState = iota
+	evaluating
+	evaluated
+	failed
+)
+
+// errReported is returned when evaluating a constant whose definition
+// has already been reported as erroneous.
+var errReported = &Error{Msg: "error already reported"}
+
+// directive parses the assembler directive tok with the given arguments.
+func (a *assembler) directive(tok token, args []token) *Error {
+	switch tok.text {
+	case ".equ", ".set":
+		if err := checkDirectiveArgs(tok, args, 2, 2); err != nil {
+			return err
+		}
+		return a.defineConstant(args[0], args[1], tok.text == ".set")
+	case ".macro":
+		err := a.defineMacro(tok, args)
+		if err != nil {
+			// skip the body of the invalid definition
+			a.defining = &macro{name: tok, invalid: true}
+		}
+		return err
+	case ".endm":
+		return errorf(tok, ".endm without .macro")
+	case ".include":
+		if err := checkDirectiveArgs(tok, args, 1, 1); err != nil {
+			return err
+		}
+		return a.include(tok, args[0])
+	case ".text", ".data":
+		if err := checkDirectiveArgs(tok, args, 0, 0); err != nil {
+			return err
+		}
+		if a.section = TextSection; tok.text == ".data" {
+			a.section = DataSection
+		}
+		return nil
+	case ".global", ".globl":
+		if err := checkDirectiveArgs(tok, args, 1, -1); err != nil {
+			return err
+		}
+		for _, arg := range args {
+			if !isIdent(arg.text) {
+				return errorf(arg, "%s: invalid symbol name %q", tok.text, arg.text)
+			}
+			if _, exist := a.globals[arg.text]; !exist {
+				a.globals[arg.text] = arg
+			}
+		}
+		return nil
+	case ".entry":
+		if err := checkDirectiveArgs(tok, args, 1, 1); err != nil {
+			return err
+		}
+		if a.relocatable {
+			return errorf(tok, "%s: modules have no entry point (use tinyvm link -entry)", tok.text)
+		}
+		if a.entry != nil {
+			return errorf(args[0], "%s: entry point redefined (previously defined at %v)", tok.text, a.entry.tok.pos)
+		}
+		x, err := parseExpr(args[0], 0)
+		if err != nil {
+			err.Msg = tok.text + ": " + err.Msg
+			return err
+		}
+		a.entry = &reference{tok: args[0], expr: x, seq: a.seq, kind: "label"}
+		return nil
+	case ".extern":
+		if err := checkDirectiveArgs(tok, args, 1, -1); err != nil {
+			return err
+		}
+		if !a.relocatable {
+			return errorf(tok, "%s: symbols can only be imported by modules (use AssembleModule)", tok.text)
+		}
+		for _, arg := range args {
+			if err := a.defineExtern(tok, arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// all other directives emit data
+	if a.section != DataSection {
+		if _, ok := dataDirectives[tok.text]; ok {
+			return errorf(tok, "%s: not in data section (use .data)", tok.text)
+		}
+		return errorf(tok, "unknown directive %q", tok.text)
+	}
+	switch tok.text {
+	case ".word", ".byte":
+		if err := checkDirectiveArgs(tok, args, 1, -1); err != nil {
+			return err
+		}
+		size := dataDirectives[tok.text]
+		for _, arg := range args {
+			if err := a.emitValue(tok, arg, size); err != nil {
+				return err
+			}
+		}
+	case ".string":
+		if err := checkDirectiveArgs(tok, args, 1, -1); err != nil {
+			return err
+		}
+		for _, arg := range args {
+			str, err := strconv.Unquote(arg.text)
+			if err != nil || !strings.HasPrefix(arg.text, `"`) {
+				return errorf(arg, "%s: invalid string %q", tok.text, arg.text)
+			}
+			// strings are zero terminated
+			a.data = append(append(a.data, str...), 0)
+		}
+	case ".space":
+		if err := checkDirectiveArgs(tok, args, 1, 2); err != nil {
+			return err
+		}
+		size, err := a.constValue(tok, args[0])
+		if err != nil {
+			return err
+		}
+		var fill uint32
+		if len(args) > 1 {
+			if fill, err = a.constValue(tok, args[1]); err != nil {
+				return err
+			}
+			if !fitsSize(fill, 1) {
+				return errorf(args[1], "%s: fill value %q out of range (min -128, max 255)", tok.text, args[1].text)
+			}
+		}
+		if err := a.checkDataSize(tok, args[0], uint64(len(a.data))+uint64(size)); err != nil {
+			return err
+		}
+		for i := uint32(0); i < size; i++ {
+			a.data = append(a.data, byte(fill))
+		}
+	case ".align":
+		if err := checkDirectiveArgs(tok, args, 0, 1); err != nil {
+			return err
+		}
+		n := uint32(4)
+		if len(args) > 0 {
+			var err *Error
+			if n, err = a.constValue(tok, args[0]); err != nil {
+				return err
+			}
+			if n == 0 || n&(n-1) != 0 || n > MaxDataSize {
+				return errorf(args[0], "%s: alignment %q is not a power of 2", tok.text, args[0].text)
+			}
+		}
+		a.align(int(n))
+	case ".org":
+		if err := checkDirectiveArgs(tok, args, 1, 1); err != nil {
+			return err
+		}
+		offset, err := a.constValue(tok, args[0])
+		if err != nil {
+			return err
+		}
+		if int(offset) < len(a.data) {
+			return errorf(args[0], "%s: cannot move backwards from offset %d to %d", tok.text, len(a.data), offset)
+		}
+		if err := a.checkDataSize(tok, args[0], uint64(offset)); err != nil {
+			return err
+		}
+		a.data = append(a.data, make([]byte, int(offset)-len(a.data))...)
+	}
+	return nil
+}
+
+// dataDirectives contains the directives emitting data and the size of
+// their values in bytes, if any.
+var dataDirectives = map[string]int{
+	".word":   4,
+	".byte":   1,
+	".string": 1,
+	".space":  0,
+	".align":  0,
+	".org":    0,
+}
+
+// MaxDataSize is the maximum size of the data section in bytes.
+const MaxDataSize = 1 << 24
+
+// emitValue appends the value of tok of the given size in bytes, big
+// endian encoded, to the data section. Values referring to symbols which
+// aren't defined yet are written at link time.
+func (a *assembler) emitValue(dir, tok token, size int) *Error {
+	value, ref, err := a.parseValue(dir.text, tok, 0, "symbol")
+	if err != nil {
+		return err
+	}
+	offset := len(a.data)
+	a.data = append(a.data, make([]byte, size)...)
+	if ref != nil {
+		a.dataRefs[offset] = &dataRef{dir: dir.text, ref: ref, size: size}
+		return nil
+	}
+	return a.writeValue(dir.text, tok, offset, size, value)
+}
+
+// writeValue writes value to the data section at the given offset.
+func (a *assembler) writeValue(name string, tok token, offset, size int, value uint32) *Error {
+	if !fitsSize(value, size) {
+		return errorf(tok, "%s: value %q out of range (min %d, max %d)", name, tok.text, -(1 << (size*8 - 1)), uint32(1<<(size*8)-1))
+	}
+	for i := 0; i < size; i++ {
+		a.data[offset+i] = byte(value >> (8 * (size - i - 1)))
+	}
+	return nil
+}
+
+// fitsSize returns whether the value, which may be negative in two's
+// complement, fits in size bytes.
+func fitsSize(value uint32, size int) bool {
+	if size >= 4 {
+		return true
+	}
+	bits := size * 8
+	return value < 1<<bits || value >= -(uint32(1)<<(bits-1))
+}
+
+// constValue parses tok as value of directive dir, which must be known at
+// this point of the source.
+func (a *assembler) constValue(dir, tok token) (uint32, *Error) {
+	value, ref, err := a.parseValue(dir.text, tok, 0, "symbol")
+	if err != nil {
+		return 0, err
+	}
+	if ref != nil {
+		return 0, errorf(tok, "%s: %q is not a constant defined before its use", dir.text, tok.text)
+	}
+	return value, nil
+}
+
+// checkDataSize returns an error if the data section would grow beyond
+// MaxDataSize.
+func (a *assembler) checkDataSize(dir, tok token, size uint64) *Error {
+	if size > MaxDataSize {
+		return errorf(tok, "%s: data section exceeds %d bytes", dir.text, MaxDataSize)
+	}
+	return nil
+}
+
+// align pads the data section with zeros to a multiple of n bytes.
+func (a *assembler) align(n int) {
+	for len(a.data)%n != 0 {
+		a.data = append(a.data, 0)
+	}
+}
+
+// linkData resolves the data values referring to symbols which weren't
+// known when they were parsed.
+func (a *assembler) linkData() {
+	offsets := make([]int, 0, len(a.dataRefs))
+	for offset := range a.dataRefs {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	for _, offset := range offsets {
+		d := a.dataRefs[offset]
+		value, relocated, err := a.finalValue(d.ref, d.dir, DataSection, offset, d.size)
+		if err != nil {
+			if err != errReported {
+				a.errs = append(a.errs, err)
+			}
+			continue
+		}
+		if relocated {
+			continue
+		}
+		if err := a.writeValue(d.dir, d.ref.tok, offset, d.size, value); err != nil {
+			a.errs = append(a.errs, err)
+		}
+	}
+}
+
+// checkDirectiveArgs returns an error if the amount of arguments of the
+// directive is not within the given bounds.
+// A max of -1 allows any amount of arguments.
+func checkDirectiveArgs(tok token, args []token, min, max int) *Error {
+	if max >= 0 && len(args) > max {
+		return errorf(args[max], "%s: too many arguments: expected %d, got %d", tok.text, max, len(args))
+	}
+	if len(args) < min {
+		return errorf(tok, "%s: not enough arguments: expected %d, got %d", tok.text, min, len(args))
+	}
+	return nil
+}
+
+// defineConstant defines the constant name. Constants defined by .set
+// may be redefined by another .set, in which case references resolve to
+// the definition preceding them.
+func (a *assembler) defineConstant(name, value token, set bool) *Error {
+	if !isIdent(name.text) || isRegister(name.text) {
+		return errorf(name, "invalid constant name %q", name.text)
+	}
+	if pos, exist := a.labelPos[name.text]; exist {
+		return errorf(name, "constant %q redefines label (defined at %v)", name.text, pos)
+	}
+	if tok, exist := a.externs[name.text]; exist {
+		return errorf(name, "constant %q redefines imported symbol (declared at %v)", name.text, tok.pos)
+	}
+	if defs := a.consts[name.text]; len(defs) > 0 && (!set || !defs[0].set) {
+		return errorf(name, "constant %q redefined (previously defined at %v)", name.text, defs[0].name.pos)
+	}
+	x, err := parseExpr(value, 0)
+	if err != nil {
+		return err
+	}
+	a.consts[name.text] = append(a.consts[name.text], &constant{name: name, expr: x, seq: a.seq, set: set})
+	a.seq++
+	return nil
+}
+
+// constant returns the definition of the constant name which is in effect
+// for a reference preceded by seq definitions. This is the last definition
+// preceding the reference or, for forward references, the first one.
+func (a *assembler) constant(name string, seq int) *constant {
+	defs := a.consts[name]
+	if len(defs) == 0 {
+		return nil
+	}
+	c := defs[0]
+	for _, def := range defs[1:] {
+		if def.seq < seq {
+			c = def
+		}
+	}
+	return c
+}
+
+// resolver returns a resolver for an expression preceded by seq constant
+// definitions. Symbols which aren't defined are reported as undefined
+// kind (label or symbol). Unless final is set, failed evaluations aren't
+// recorded, which allows expressions to be evaluated before all symbols
+// are known. Labels of modules are relative to their section and imported
+// symbols are relative to themselves.
+func (a *assembler) resolver(seq int, kind string, final bool) resolver {
+	return func(tok token) (exprValue, *Error) {
+		if addr, ok := a.labels[tok.text]; ok {
+			if !a.relocatable {
+				return absolute(int64(addr)), nil
+			}
+			if a.dataLabels[tok.text] {
+				return relative(base{section: DataSection}, int64(addr)), nil
+			}
+			return relative(base{section: TextSection}, int64(addr)), nil
+		}
+		if c := a.constant(tok.text, seq); c != nil {
+			return a.evalConst(c, final)
+		}
+		if _, ok := a.externs[tok.text]; ok {
+			return relative(base{section: UndefSection, symbol: tok.text}, 0), nil
+		}
+		if match := a.closestLabel(tok.text); match != "" {
+			return exprValue{}, errorf(tok, "undefined %s %q (did you mean %q?)", kind, tok.text, match)
+		}
+		return exprValue{}, errorf(tok, "undefined %s %q", kind, tok.text)
+	}
+}
+
+// refResolver returns the resolver for the expression of ref. Data labels
+// referred to by byte addressed operands resolve to the address of their
+// first byte. Data labels within constants aren't scaled. Imported symbols
+// may or may not be data labels and are rejected as byte address.
+func (a *assembler) refResolver(ref *reference, final bool) resolver {
+	resolve := a.resolver(ref.seq, ref.kind, final)
+	if !ref.byteAddr {
+		return resolve
+	}
+	return func(tok token) (exprValue, *Error) {
+		v, err := resolve(tok)
+		if err != nil {
+			return v, err
+		}
+		if a.dataLabels[tok.text] {
+			return absolute(0).add(v, 4), nil
+		}
+		if b, _, _, ok := v.relocation(); ok && b.section == UndefSection && b.symbol == tok.text {
+			return exprValue{}, errorf(tok, "byte address of imported symbol %q is unknown (use ldr rN =%s*4 if it is a data label)", tok.text, tok.text)
+		}
+		return v, nil
+	}
+}
+
+// evalConst evaluates the value of constant c.
+func (a *assembler) evalConst(c *constant, final bool) (exprValue, *Error) {
+	switch c.state {
+	case evaluated:
+		return c.value, nil
+	case evaluating:
+		return exprValue{}, errorf(c.name, "constant %q is defined in terms of itself", c.name.text)
+	case failed:
+		return exprValue{}, errReported
+	}
+	c.state = evaluating
+	value, err := c.expr.eval(a.resolver(c.seq, "symbol", final))
+	if err != nil {
+		if c.state = unevaluated; final {
+			c.state = failed
+		}
+		return exprValue{}, err
+	}
+	c.state, c.value = evaluated, value
+	return value, nil
+}
+
+// defineExtern declares the symbol named by tok to be imported from
+// another module.
+func (a *assembler) defineExtern(dir, tok token) *Error {
+	if !isIdent(tok.text) || isRegister(tok.text) {
+		return errorf(tok, "%s: invalid symbol name %q", dir.text, tok.text)
+	}
+	if pos, exist := a.labelPos[tok.text]; exist {
+		return errorf(tok, "%s: imported symbol %q is defined as label (at %v)", dir.text, tok.text, pos)
+	}
+	if defs := a.consts[tok.text]; len(defs) > 0 {
+		return errorf(tok, "%s: imported symbol %q is defined as constant (at %v)", dir.text, tok.text, defs[0].name.pos)
+	}
+	if _, exist := a.externs[tok.text]; !exist {
+		a.externs[tok.text] = tok
+	}
+	return nil
+}
+
+// checkGlobals reports the symbols declared global by .global which
+// aren't defined as label.
+func (a *assembler) checkGlobals() {
+	names := make([]string, 0, len(a.globals))
+	for name := range a.globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := a.labels[name]; ok {
+			continue
+		}
+		tok := a.globals[name]
+		if len(a.consts[name]) > 0 || a.externs[name].text != "" {
+			a.errs = append(a.errs, errorf(tok, "global symbol %q is not a label", name))
+		} else {
+			a.errs = append(a.errs, errorf(tok, "global symbol %q is not defined", name))
+		}
+	}
+}
+
+// include parses the file named by tok in place of the .include directive.
+func (a *assembler) include(dir, tok token) *Error {
+	name, err := strconv.Unquote(tok.text)
+	if err != nil || !strings.HasPrefix(tok.text, `"`) {
+		return errorf(tok, "%s: invalid file name %q", dir.text, tok.text)
+	}
+	if a.fsys == nil {
+		return errorf(dir, "%s: no file system to include %q from (use AssembleFS)", dir.text, name)
+	}
+	file, code, err := a.findInclude(tok.pos.File, name)
+	if err != nil {
+		return errorf(tok, "%s: %v", dir.text, err)
+	}
+	for i, f := range a.files {
+		if f == file {
+			cycle := append(append([]string(nil), a.files[i:]...), file)
+			return errorf(tok, "%s: include cycle: %s", dir.text, strings.Join(cycle, " -> "))
+		}
+	}
+
+	a.files = append(a.files, file)
+	a.parseSource(file, string(code), tok.exp)
+	a.files = a.files[:len(a.files)-1]
+	return nil
+}
+
+// findInclude looks up the file name included from the file from,
+// relative to from and then in the include paths. It returns the path of
+// the file and its contents.
+func (a *assembler) findInclude(from, name string) (string, []byte, error) {
+	candidates := []string{name}
+	if !path.IsAbs(name) {
+		candidates[0] = path.Join(path.Dir(from), name)
+		for _, dir := range a.includePaths {
+			candidates = append(candidates, path.Join(dir, name))
+		}
+	}
+	for _, file := range candidates {
+		code, err := fs.ReadFile(a.fsys, file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return file, code, err
+	}
+	return "", nil, fmt.Errorf("file %q not found", name)
+}
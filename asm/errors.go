@@ -0,0 +1,69 @@
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Pos is a position in the source code.
+type Pos struct {
+	File string // file name, empty unless assembled from a file system
+	Line int    // line number, starting at 1
+	Col  int    // column, starting at 1
+}
+
+func (p Pos) String() string {
+	if p.File != "" {
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// Error is an error found in the source code during assembly.
+type Error struct {
+	Pos   Pos    // position of the offending token
+	Token string // offending token
+	Msg   string // error message
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %s", e.Pos, e.Msg)
+}
+
+// ErrorList is a list of assembly errors. Assemble returns an ErrorList
+// containing every error found in the source code.
+type ErrorList []*Error
+
+// Sort sorts the list by position: file, line and column. Errors at the
+// same position keep their order.
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := l[i].Pos, l[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+}
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// errorf returns an error for the given token. Errors in macro expansions
+// name the macro invocations leading up to the token.
+func errorf(tok token, format string, args ...interface{}) *Error {
+	msg := fmt.Sprintf(format, args...)
+	if tok.exp != nil {
+		msg += " (" + tok.exp.String() + ")"
+	}
+	return &Error{Pos: tok.pos, Token: tok.text, Msg: msg}
+}
@@ -0,0 +1,336 @@
+package asm
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// expr is a constant expression. Expressions may refer to labels and
+// constants and are evaluated once the symbols they refer to are known.
+type expr interface {
+	eval(resolve resolver) (exprValue, *Error)
+}
+
+// resolver returns the value of the symbol referred to by tok.
+type resolver func(tok token) (exprValue, *Error)
+
+// base is the unknown address a relocatable value is relative to: the
+// start of a section of a module or an imported symbol.
+type base struct {
+	section Section
+	symbol  string // imported symbol, if section is UndefSection
+}
+
+// exprValue is the value of an expression: a constant plus the sum of the
+// bases times their factor. Values in relocatable modules depend on the
+// addresses of the sections and imported symbols, which aren't known until
+// the module is linked. All other values are absolute (constant).
+type exprValue struct {
+	n     int64
+	bases map[base]int64
+}
+
+// absolute returns an absolute value.
+func absolute(n int64) exprValue {
+	return exprValue{n: n}
+}
+
+// relative returns the value at offset n of b.
+func relative(b base, n int64) exprValue {
+	return exprValue{n: n, bases: map[base]int64{b: 1}}
+}
+
+// isAbs returns whether v is absolute.
+func (v exprValue) isAbs() bool {
+	return len(v.bases) == 0
+}
+
+// add returns v + factor * w.
+func (v exprValue) add(w exprValue, factor int64) exprValue {
+	sum := exprValue{n: v.n + factor*w.n}
+	for _, bases := range []map[base]int64{v.bases, w.bases} {
+		for b := range bases {
+			if f := v.bases[b] + factor*w.bases[b]; f != 0 {
+				if sum.bases == nil {
+					sum.bases = make(map[base]int64)
+				}
+				sum.bases[b] = f
+			}
+		}
+	}
+	return sum
+}
+
+// relocation returns the base, scale and offset of a value relative to a
+// single base, if it is. The base is either an address (scale 1) or the
+// byte address of a word address (scale 4).
+func (v exprValue) relocation() (base, int64, int64, bool) {
+	if len(v.bases) != 1 {
+		return base{}, 0, 0, false
+	}
+	for b, f := range v.bases {
+		if f == 1 || f == 4 {
+			return b, f, v.n, true
+		}
+	}
+	return base{}, 0, 0, false
+}
+
+type (
+	// numExpr is a numeric literal.
+	numExpr struct{ value int64 }
+	// symExpr is a reference to a label or constant.
+	symExpr struct{ tok token }
+	// unaryExpr is a unary operation (-x, ~x).
+	unaryExpr struct {
+		op token
+		x  expr
+	}
+	// binaryExpr is a binary operation (x op y).
+	binaryExpr struct {
+		op   token
+		x, y expr
+	}
+)
+
+func (e numExpr) eval(resolve resolver) (exprValue, *Error) { return absolute(e.value), nil }
+func (e symExpr) eval(resolve resolver) (exprValue, *Error) { return resolve(e.tok) }
+
+func (e unaryExpr) eval(resolve resolver) (exprValue, *Error) {
+	x, err := e.x.eval(resolve)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if e.op.text == "~" {
+		if !x.isAbs() {
+			return exprValue{}, errorf(e.op, "operator %q not allowed on relocatable address", "~")
+		}
+		return absolute(int64(^uint32(x.n))), nil
+	}
+	return absolute(0).add(x, -1), nil
+}
+
+func (e binaryExpr) eval(resolve resolver) (exprValue, *Error) {
+	x, err := e.x.eval(resolve)
+	if err != nil {
+		return exprValue{}, err
+	}
+	y, err := e.y.eval(resolve)
+	if err != nil {
+		return exprValue{}, err
+	}
+	// relocatable addresses may only be added to, subtracted from and
+	// multiplied by constants.
+	switch {
+	case e.op.text == "+":
+		return x.add(y, 1), nil
+	case e.op.text == "-":
+		return x.add(y, -1), nil
+	case e.op.text == "*" && x.isAbs():
+		return absolute(0).add(y, x.n), nil
+	case e.op.text == "*" && y.isAbs():
+		return absolute(0).add(x, y.n), nil
+	case !x.isAbs() || !y.isAbs():
+		return exprValue{}, errorf(e.op, "operator %q not allowed on relocatable address", e.op.text)
+	}
+	switch x, y := x.n, y.n; e.op.text {
+	case "/", "%":
+		if y == 0 {
+			return exprValue{}, errorf(e.op, "division by zero")
+		}
+		if e.op.text == "/" {
+			return absolute(x / y), nil
+		}
+		return absolute(x % y), nil
+	case "<<", ">>":
+		if y < 0 || y > 31 {
+			return exprValue{}, errorf(e.op, "invalid shift amount %d", y)
+		}
+		if e.op.text == "<<" {
+			return absolute(int64(uint32(x) << y)), nil
+		}
+		return absolute(int64(uint32(x) >> y)), nil
+	case "&":
+		return absolute(x & y), nil
+	case "|":
+		return absolute(x | y), nil
+	case "^":
+		return absolute(x ^ y), nil
+	}
+	panic("unknown operator " + e.op.text)
+}
+
+// binaryPrec contains the precedence of the binary operators.
+var binaryPrec = map[string]int{
+	"|":  1,
+	"^":  2,
+	"&":  3,
+	"<<": 4, ">>": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// exprParser parses the expression contained in a single token.
+type exprParser struct {
+	tok token // token containing the expression
+	off int   // offset of the next character in tok
+}
+
+// parseExpr parses the expression in tok, skipping the first skip bytes
+// (e.g. the # of an immediate).
+func parseExpr(tok token, skip int) (expr, *Error) {
+	p := &exprParser{tok: tok, off: skip}
+	x, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.off < len(tok.text) {
+		return nil, p.unexpected()
+	}
+	return x, nil
+}
+
+// parseBinary parses a binary expression consisting of operators with a
+// precedence of at least prec.
+func (p *exprParser) parseBinary(prec int) (expr, *Error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOp()
+		if binaryPrec[op.text] < prec {
+			return x, nil
+		}
+		p.off += len(op.text)
+		y, err := p.parseBinary(binaryPrec[op.text] + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+// parseUnary parses a unary expression or operand.
+func (p *exprParser) parseUnary() (expr, *Error) {
+	if p.skipSpace(); p.off >= len(p.tok.text) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	switch c := p.tok.text[p.off]; {
+	case c == '-' || c == '~':
+		op := p.token(p.off, p.off+1)
+		p.off++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{op: op, x: x}, nil
+	case c == '(':
+		p.off++
+		x, err := p.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		if p.skipSpace(); p.off >= len(p.tok.text) || p.tok.text[p.off] != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.off++
+		return x, nil
+	case c >= '0' && c <= '9' || c == '\'':
+		return p.parseNumber()
+	default:
+		start := p.off
+		for p.off < len(p.tok.text) && isIdentChar(p.tok.text[p.off], p.off > start) {
+			p.off++
+		}
+		if p.off == start {
+			return nil, p.unexpected()
+		}
+		return symExpr{tok: p.token(start, p.off)}, nil
+	}
+}
+
+// parseNumber parses a numeric literal.
+func (p *exprParser) parseNumber() (expr, *Error) {
+	start := p.off
+	if p.tok.text[p.off] == '\'' {
+		for p.off++; p.off < len(p.tok.text) && p.tok.text[p.off] != '\''; p.off++ {
+			if p.tok.text[p.off] == '\\' {
+				p.off++
+			}
+		}
+		p.off = min(p.off+1, len(p.tok.text))
+	} else {
+		for p.off < len(p.tok.text) && isIdentChar(p.tok.text[p.off], true) {
+			p.off++
+		}
+	}
+	value, err := parseNumber(p.tok.text[start:p.off])
+	if errors.Is(err, strconv.ErrRange) {
+		return nil, errorf(p.tok, "immediate %q out of range (min %d, max %d)", p.tok.text, math.MinInt32, uint32(math.MaxUint32))
+	}
+	if err != nil {
+		return nil, errorf(p.tok, "invalid immediate %q", p.tok.text)
+	}
+	return numExpr{value: int64(value)}, nil
+}
+
+// peekOp returns the binary operator at the current offset without
+// consuming it.
+func (p *exprParser) peekOp() token {
+	p.skipSpace()
+	rest := p.tok.text[p.off:]
+	for _, n := range []int{2, 1} {
+		if len(rest) >= n {
+			if _, ok := binaryPrec[rest[:n]]; ok {
+				return p.token(p.off, p.off+n)
+			}
+		}
+	}
+	return token{}
+}
+
+func (p *exprParser) skipSpace() {
+	for p.off < len(p.tok.text) && (p.tok.text[p.off] == ' ' || p.tok.text[p.off] == '\t') {
+		p.off++
+	}
+}
+
+// token returns the part of the expression between start and end as token.
+func (p *exprParser) token(start, end int) token {
+	return token{text: p.tok.text[start:end], pos: Pos{File: p.tok.pos.File, Line: p.tok.pos.Line, Col: p.tok.pos.Col + start}, exp: p.tok.exp}
+}
+
+func (p *exprParser) unexpected() *Error {
+	return p.errorf("unexpected %q", p.tok.text[p.off:p.off+1])
+}
+
+// errorf returns an error for the expression at the current offset.
+func (p *exprParser) errorf(format string, args ...interface{}) *Error {
+	err := errorf(p.token(p.off, p.off), "invalid expression %q: "+format, append([]interface{}{p.tok.text}, args...)...)
+	err.Token = p.tok.text
+	return err
+}
+
+// isIdentChar returns whether c may be part of an identifier. Digits are
+// only allowed when c isn't the first character.
+func isIdentChar(c byte, notFirst bool) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || notFirst && c >= '0' && c <= '9'
+}
+
+// isExpr returns whether s is an expression rather than a register or
+// immediate, e.g. a label reference.
+func isExpr(s string) bool {
+	return !isImmediate(s) && !isRegister(s) && !looksLikeRegister(s) && !strings.HasPrefix(s, literalPrefix)
+}
+
+// toValue converts the result of an expression to an immediate value,
+// reporting whether it fits in 32 bits.
+func toValue(v int64) (uint32, bool) {
+	if v < math.MinInt32 || v > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(v), true
+}
@@ -0,0 +1,58 @@
+package asm
+
+// token is a single field of a source line.
+type token struct {
+	text string
+	pos  Pos
+	exp  *expansion // macro expansion the token is part of, if any
+}
+
+// tokenize splits a line of source code in to tokens. Tokens are separated
+// by whitespace or commas and comments are discarded. Quoted text and
+// bracketed groups (e.g. `(a + b)`, `[r1, #4]`, `{r4-r7}`) are kept
+// together as a single token.
+func tokenize(line, file string, lineNum int) []token {
+	var (
+		toks  []token
+		start = -1 // start of the current token
+		depth int  // bracket nesting depth
+		quote byte // opening quote of a quoted text
+	)
+	flush := func(end int) {
+		if start >= 0 {
+			toks = append(toks, token{text: line[start:end], pos: Pos{File: file, Line: lineNum, Col: start + 1}})
+			start = -1
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			if depth > 0 {
+				depth--
+			}
+		case depth == 0 && c == comment[0]:
+			flush(i)
+			return toks
+		case depth == 0 && (c == ' ' || c == '\t' || c == '\r' || c == ','):
+			flush(i)
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	flush(len(line))
+	return toks
+}
@@ -0,0 +1,193 @@
+package asm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Link combines the modules in to a single executable object. The code and
+// data sections of the modules are concatenated in the given order, data
+// sections aligned to 4 bytes, and the relocations are resolved using the
+// final addresses. Symbols imported by a module must be exported by exactly
+// one other module. The returned symbol table contains the addresses of
+// the exported code labels. All undefined and duplicate symbols are
+// reported.
+func Link(modules ...*Module) (*Object, SymbolTable, error) {
+	var (
+		obj      = new(Object)
+		textBase = make([]uint32, len(modules)) // first instruction of the modules
+		dataBase = make([]uint32, len(modules)) // first data word of the modules
+		errs     []error
+	)
+	for i, m := range modules {
+		if len(m.Code)%4 != 0 {
+			return nil, nil, fmt.Errorf("%s: code length %d is not a multiple of 4", moduleName(m, i), len(m.Code))
+		}
+		for len(obj.Data)%4 != 0 {
+			obj.Data = append(obj.Data, 0)
+		}
+		textBase[i], dataBase[i] = uint32(len(obj.Code)/4), uint32(len(obj.Data)/4)
+		obj.Code = append(obj.Code, m.Code...)
+		obj.Data = append(obj.Data, m.Data...)
+	}
+	if len(obj.Data) > MaxDataSize {
+		return nil, nil, fmt.Errorf("data section of %d bytes exceeds %d bytes", len(obj.Data), MaxDataSize)
+	}
+
+	// collect the exported symbols
+	type global struct {
+		addr   uint32
+		module int
+	}
+	var (
+		globals = make(map[string]global)
+		symbols = make(SymbolTable)
+	)
+	for i, m := range modules {
+		for _, sym := range m.Symbols {
+			if !sym.Global || sym.Section == UndefSection {
+				continue
+			}
+			if prev, exist := globals[sym.Name]; exist {
+				errs = append(errs, fmt.Errorf("duplicate symbol %q (defined by %s and %s)", sym.Name, moduleName(modules[prev.module], prev.module), moduleName(m, i)))
+				continue
+			}
+			addr, err := sectionBase(sym.Section, textBase[i], dataBase[i])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: symbol %q: %v", moduleName(m, i), sym.Name, err))
+				continue
+			}
+			globals[sym.Name] = global{addr: addr + sym.Value, module: i}
+			if sym.Section == TextSection {
+				symbols[sym.Name] = addr + sym.Value
+			}
+		}
+	}
+
+	// resolve the relocations
+	for i, m := range modules {
+		undefined := make(map[string]bool)
+		for _, r := range m.Relocs {
+			var addr uint32
+			if r.Base == UndefSection {
+				g, ok := globals[r.Symbol]
+				if !ok {
+					if !undefined[r.Symbol] {
+						errs = append(errs, fmt.Errorf("undefined symbol %q (referenced by %s)", r.Symbol, moduleName(m, i)))
+						undefined[r.Symbol] = true
+					}
+					continue
+				}
+				addr = g.addr
+			} else {
+				var err error
+				if addr, err = sectionBase(r.Base, textBase[i], dataBase[i]); err != nil {
+					errs = append(errs, fmt.Errorf("%s: relocation: %v", moduleName(m, i), err))
+					continue
+				}
+			}
+			if err := relocate(obj, m, r, textBase[i], dataBase[i]*4, int64(addr)*int64(max(r.Scale, 1))+int64(r.Addend)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", moduleName(m, i), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return obj, symbols, nil
+}
+
+// moduleName returns the name of the i-th module used in link errors.
+func moduleName(m *Module, i int) string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return fmt.Sprintf("module %d", i)
+}
+
+// sectionBase returns the address of the start of section.
+func sectionBase(section Section, text, data uint32) (uint32, error) {
+	switch section {
+	case TextSection:
+		return text, nil
+	case DataSection:
+		return data, nil
+	}
+	return 0, fmt.Errorf("invalid section %v", section)
+}
+
+// relocate sets the value of relocation r of module m, whose code starts at
+// instruction text and whose data starts at byte offset data of obj.
+func relocate(obj *Object, m *Module, r Reloc, text, data uint32, v int64) error {
+	value, ok := toValue(v)
+	if !ok {
+		return fmt.Errorf("relocated value %d out of range (min %d, max %d)", v, math.MinInt32, uint32(math.MaxUint32))
+	}
+	switch r.Section {
+	case TextSection:
+		if r.Offset >= uint32(len(m.Code)/4) {
+			return fmt.Errorf("relocation of instruction %d out of bounds", r.Offset)
+		}
+		pc := text + r.Offset
+		instr := DecodeInstruction(binary.BigEndian.Uint32(obj.Code[pc*4:]))
+		switch instr.Op {
+		case Movw:
+			instr.Value = value & MaxWideImmediate
+		case Movt:
+			instr.Value = value >> 16
+		case Svc:
+			if value > MaxWideImmediate {
+				return fmt.Errorf("%s at %d: relocated syscall number %d out of range (max %d)", instr.Op, r.Offset, value, MaxWideImmediate)
+			}
+			instr.Value = value
+		case B, Bl:
+			// branches are relative to the branch instruction
+			offset := v - int64(pc)
+			if !isBranchOffset(offset) {
+				return fmt.Errorf("%s at %d: offset %d of %s out of range (min %d, max %d)", instr.Op, r.Offset, offset, relocName(r), MinBranchOffset, MaxBranchOffset)
+			}
+			instr.Value = uint32(offset)
+		default:
+			if instr.Addr != AddrDirect {
+				if !isTransferOffset(v) {
+					return fmt.Errorf("%s at %d: offset %d of %s out of range (min %d, max %d)", instr.Op, r.Offset, v, relocName(r), MinTransferOffset, MaxTransferOffset)
+				}
+				instr.Value = value
+				break
+			}
+			if !setImmediate(&instr, value) {
+				return fmt.Errorf("%s at %d: relocated value %d cannot be encoded as immediate (use ldr rN =%s)", instr.Op, r.Offset, value, relocName(r))
+			}
+		}
+		encoded, err := EncodeInstruction(instr)
+		if err != nil {
+			return fmt.Errorf("relocation of instruction %d: %v", r.Offset, err)
+		}
+		binary.BigEndian.PutUint32(obj.Code[pc*4:], encoded)
+	case DataSection:
+		size := int(r.Size)
+		if size != 1 && size != 4 || uint64(r.Offset)+uint64(size) > uint64(len(m.Data)) {
+			return fmt.Errorf("relocation of data at %d out of bounds", r.Offset)
+		}
+		offset := data + r.Offset
+		if !fitsSize(value, size) {
+			return fmt.Errorf("relocated value %d of data at %d out of range (min %d, max %d)", v, r.Offset, -(1 << (size*8 - 1)), uint32(1<<(size*8)-1))
+		}
+		for i := 0; i < size; i++ {
+			obj.Data[int(offset)+i] = byte(value >> (8 * (size - i - 1)))
+		}
+	default:
+		return fmt.Errorf("relocation in invalid section %v", r.Section)
+	}
+	return nil
+}
+
+// relocName returns the symbol a relocation is relative to.
+func relocName(r Reloc) string {
+	if r.Base == UndefSection {
+		return r.Symbol
+	}
+	return r.Base.String()
+}
@@ -0,0 +1,175 @@
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxMacroDepth is the maximum nesting depth of macro expansions, which
+// limits (unintended) recursion.
+const MaxMacroDepth = 64
+
+// macro is a user defined macro.
+//
+//	.macro name param1, param2=default
+//		...
+//	.endm
+//
+// Parameters are referred to in the body as \param. \@ is replaced by a
+// number unique to each expansion, which allows for local labels.
+type macro struct {
+	name     token
+	params   []string
+	defaults map[string]string // default arguments by parameter
+	body     []macroLine
+	invalid  bool // definition contains errors, the macro isn't defined
+}
+
+// macroLine is a line of a macro body.
+type macroLine struct {
+	text string
+	file string // file of the definition
+	line int    // line number of the definition
+}
+
+// expansion is a macro expansion.
+type expansion struct {
+	macro  *macro
+	pos    Pos        // position of the invocation
+	parent *expansion // expansion containing the invocation, if any
+	depth  int        // nesting depth of the expansion
+}
+
+// String returns the chain of invocations leading up to the expansion,
+// eliding the middle of deeply nested expansions.
+func (e *expansion) String() string {
+	var chain []string
+	for ; e != nil; e = e.parent {
+		chain = append(chain, fmt.Sprintf("in macro %q invoked at %v", e.macro.name.text, e.pos))
+	}
+	if len(chain) > 4 {
+		chain = append(chain[:2:2], "...", chain[len(chain)-1])
+	}
+	return strings.Join(chain, ", ")
+}
+
+// defineMacro starts the definition of a macro. The following lines up to
+// .endm make up the body of the macro.
+func (a *assembler) defineMacro(tok token, args []token) *Error {
+	if err := checkDirectiveArgs(tok, args, 1, -1); err != nil {
+		return err
+	}
+	name := args[0]
+	if !isIdent(name.text) || isDirective(name.text) {
+		return errorf(name, "invalid macro name %q", name.text)
+	}
+	if _, _, _, ok := parseOp(name.text); ok {
+		return errorf(name, "macro %q redefines instruction", name.text)
+	}
+	if m, exist := a.macros[name.text]; exist {
+		return errorf(name, "macro %q redefined (previously defined at %v)", name.text, m.name.pos)
+	}
+
+	m := &macro{name: name, defaults: make(map[string]string)}
+	for _, arg := range args[1:] {
+		param, def, hasDefault := strings.Cut(arg.text, "=")
+		if !isIdent(param) {
+			return errorf(arg, "macro %q: invalid parameter name %q", name.text, param)
+		}
+		for _, p := range m.params {
+			if p == param {
+				return errorf(arg, "macro %q: duplicate parameter %q", name.text, param)
+			}
+		}
+		m.params = append(m.params, param)
+		if hasDefault {
+			m.defaults[param] = def
+		}
+	}
+	a.defining = m
+	return nil
+}
+
+// collectMacroLine adds a line to the body of the macro being defined or
+// ends the definition at .endm.
+func (a *assembler) collectMacroLine(line, file string, lineNum int, toks []token) {
+	m := a.defining
+	if len(toks) > 0 {
+		switch toks[0].text {
+		case ".endm":
+			if err := checkDirectiveArgs(toks[0], toks[1:], 0, 0); err != nil {
+				a.errs = append(a.errs, err)
+			}
+			if !m.invalid {
+				a.macros[m.name.text] = m
+			}
+			a.defining = nil
+			return
+		case ".macro":
+			a.errs = append(a.errs, errorf(toks[0], "macro %q: nested macro definition", m.name.text))
+			return
+		}
+	}
+	m.body = append(m.body, macroLine{text: line, file: file, line: lineNum})
+}
+
+// expandMacro expands the invocation of macro m with the given arguments.
+func (a *assembler) expandMacro(m *macro, tok token, args []token) *Error {
+	if len(args) > len(m.params) {
+		return errorf(args[len(m.params)], "macro %q: too many arguments: expected %d, got %d", m.name.text, len(m.params), len(args))
+	}
+	values := make(map[string]string, len(m.params))
+	for i, param := range m.params {
+		switch def, ok := m.defaults[param]; {
+		case i < len(args):
+			values[param] = args[i].text
+		case ok:
+			values[param] = def
+		default:
+			return errorf(tok, "macro %q: missing argument %q", m.name.text, param)
+		}
+	}
+
+	exp := &expansion{macro: m, pos: tok.pos, parent: tok.exp, depth: 1}
+	if tok.exp != nil {
+		exp.depth = tok.exp.depth + 1
+	}
+	if exp.depth > MaxMacroDepth {
+		return errorf(tok, "macro %q: expansion too deep (limit %d)", m.name.text, MaxMacroDepth)
+	}
+	values["@"] = strconv.Itoa(a.expansions)
+	a.expansions++
+
+	for _, line := range m.body {
+		a.parseLine(substitute(line.text, values), line.file, line.line, exp)
+	}
+	return nil
+}
+
+// substitute replaces the \name references in text by their value. Unknown
+// names are left as is.
+func substitute(text string, values map[string]string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			out.WriteByte(text[i])
+			continue
+		}
+		end := i + 1
+		if end < len(text) && text[end] == '@' {
+			end++
+		} else {
+			for end < len(text) && isIdentChar(text[end], end > i+1) {
+				end++
+			}
+		}
+		if value, ok := values[text[i+1:end]]; ok {
+			out.WriteString(value)
+			i = end - 1
+			continue
+		}
+		out.WriteByte(text[i])
+	}
+	return out.String()
+}
@@ -0,0 +1,216 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ModuleVersion is the current version of the module file format. Like
+// ObjectVersion it is bumped whenever the instruction set or the format
+// changes.
+const ModuleVersion = 5
+
+// moduleMagic identifies TinyVM module files.
+var moduleMagic = []byte("TVMR")
+
+// moduleHeaderSize is the size of the module header in bytes.
+const moduleHeaderSize = 24
+
+// Module is a relocatable module as assembled by AssembleModule. The
+// addresses of its labels are relative to the start of its sections until
+// it is linked with other modules by Link. A module file consists of the
+// following header followed by the code, the data section, the symbols
+// and the relocations:
+//
+//	+--------+---------+---------+--------+-------------+-------------+-------------+-------------+
+//	| Bytes  | 0 .. 3  | 4 .. 5  | 6 .. 7 | 8 .. 11     | 12 .. 15    | 16 .. 19    | 20 .. 23    |
+//	+--------+---------+---------+--------+-------------+-------------+-------------+-------------+
+//	| Field  | magic   | version | flags  | code length | data length | symbols     | relocations |
+//	+--------+---------+---------+--------+-------------+-------------+-------------+-------------+
+//
+// The magic is "TVMR" and all fields are big endian encoded. Symbols are
+// encoded as name length (2 bytes), name, section (1 byte), global flag (1
+// byte) and value (4 bytes). Relocations are encoded as section, size, base
+// and scale (1 byte each), offset (4 bytes), addend (4 bytes), symbol name
+// length (2 bytes) and symbol name.
+type Module struct {
+	Name    string   // name used in link errors, not stored in module files
+	Code    []byte   // byte code
+	Data    []byte   // data section
+	Symbols []Symbol // labels defined and symbols imported by the module
+	Relocs  []Reloc  // values to be relocated by the linker
+}
+
+// Symbol is a symbol of a module.
+type Symbol struct {
+	Name    string
+	Section Section // section of the label, UndefSection if imported
+	Value   uint32  // address relative to the start of the section
+	Global  bool    // exported by .global or imported by .extern
+}
+
+// Reloc is a value of a module which depends on the address of a section
+// or an imported symbol. The linker sets it to the address of the base
+// times the scale plus the addend. The offset of a branch (b, bl) is set to
+// the offset of that address from the branch.
+type Reloc struct {
+	Section Section // section containing the value
+	Offset  uint32  // instruction index in code, byte offset in data
+	Size    uint8   // size of a data value in bytes, 0 for instructions
+	Base    Section // section the value is relative to
+	Symbol  string  // imported symbol the value is relative to, if Base is UndefSection
+	Scale   uint8   // 4 for byte addresses of data labels, which are word addresses; 0 is the same as 1
+	Addend  int32
+}
+
+// IsModule returns whether data starts with a module header.
+func IsModule(data []byte) bool {
+	return bytes.HasPrefix(data, moduleMagic)
+}
+
+// MarshalBinary encodes the module in the module file format.
+func (m *Module) MarshalBinary() ([]byte, error) {
+	if len(m.Code)%4 != 0 {
+		return nil, fmt.Errorf("code length %d is not a multiple of 4", len(m.Code))
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(moduleMagic)
+	binary.Write(buf, binary.BigEndian, uint16(ModuleVersion))
+	binary.Write(buf, binary.BigEndian, uint16(0)) // flags (reserved)
+	binary.Write(buf, binary.BigEndian, uint32(len(m.Code)))
+	binary.Write(buf, binary.BigEndian, uint32(len(m.Data)))
+	binary.Write(buf, binary.BigEndian, uint32(len(m.Symbols)))
+	binary.Write(buf, binary.BigEndian, uint32(len(m.Relocs)))
+	buf.Write(m.Code)
+	buf.Write(m.Data)
+	for _, sym := range m.Symbols {
+		if err := writeName(buf, sym.Name); err != nil {
+			return nil, err
+		}
+		var global byte
+		if sym.Global {
+			global = 1
+		}
+		buf.Write([]byte{byte(sym.Section), global})
+		binary.Write(buf, binary.BigEndian, sym.Value)
+	}
+	for _, r := range m.Relocs {
+		buf.Write([]byte{byte(r.Section), r.Size, byte(r.Base), r.Scale})
+		binary.Write(buf, binary.BigEndian, r.Offset)
+		binary.Write(buf, binary.BigEndian, r.Addend)
+		if err := writeName(buf, r.Symbol); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeName writes the length prefixed name to buf.
+func writeName(buf *bytes.Buffer, name string) error {
+	if len(name) > 0xffff {
+		return fmt.Errorf("symbol name of %d bytes is too long", len(name))
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(name)))
+	buf.WriteString(name)
+	return nil
+}
+
+// UnmarshalBinary decodes a module in the module file format.
+func (m *Module) UnmarshalBinary(data []byte) error {
+	if !IsModule(data) {
+		return errors.New("not a module file")
+	}
+	if len(data) < moduleHeaderSize {
+		return errors.New("module file: truncated header")
+	}
+	switch version := binary.BigEndian.Uint16(data[4:]); {
+	case version < ModuleVersion:
+		return fmt.Errorf("module file: version %d was built by an older assembler, reassemble it", version)
+	case version > ModuleVersion:
+		return fmt.Errorf("module file: unsupported version %d", version)
+	}
+	var (
+		codeLen = binary.BigEndian.Uint32(data[8:])
+		dataLen = binary.BigEndian.Uint32(data[12:])
+		nsyms   = binary.BigEndian.Uint32(data[16:])
+		nrelocs = binary.BigEndian.Uint32(data[20:])
+		r       = &moduleReader{data: data, off: moduleHeaderSize}
+		code    = r.bytes(codeLen)
+		section = r.bytes(dataLen)
+	)
+	if codeLen%4 != 0 {
+		return fmt.Errorf("module file: code length %d is not a multiple of 4", codeLen)
+	}
+	var (
+		symbols []Symbol
+		relocs  []Reloc
+	)
+	for i := uint32(0); i < nsyms && r.err == nil; i++ {
+		sym := Symbol{Name: r.name()}
+		sym.Section, sym.Global = Section(r.byte()), r.byte() != 0
+		sym.Value = r.uint32()
+		symbols = append(symbols, sym)
+	}
+	for i := uint32(0); i < nrelocs && r.err == nil; i++ {
+		var reloc Reloc
+		reloc.Section, reloc.Size, reloc.Base, reloc.Scale = Section(r.byte()), r.byte(), Section(r.byte()), r.byte()
+		reloc.Offset, reloc.Addend = r.uint32(), int32(r.uint32())
+		reloc.Symbol = r.name()
+		relocs = append(relocs, reloc)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.off != len(data) {
+		return fmt.Errorf("module file: %d bytes of trailing data", len(data)-r.off)
+	}
+	m.Code = append([]byte(nil), code...)
+	m.Data = nil
+	if dataLen > 0 {
+		m.Data = append([]byte(nil), section...)
+	}
+	m.Symbols, m.Relocs = symbols, relocs
+	return nil
+}
+
+// moduleReader reads the fields of a module file, recording the first
+// read past the end of the data.
+type moduleReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *moduleReader) bytes(n uint32) []byte {
+	if r.err != nil || uint64(n) > uint64(len(r.data)-r.off) {
+		r.err = errors.New("module file: unexpected end of file")
+		return nil
+	}
+	b := r.data[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b
+}
+
+func (r *moduleReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *moduleReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *moduleReader) name() string {
+	b := r.bytes(2)
+	if b == nil {
+		return ""
+	}
+	return string(r.bytes(uint32(binary.BigEndian.Uint16(b))))
+}
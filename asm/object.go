@@ -0,0 +1,105 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ObjectVersion is the current version of the object file format. The
+// version is bumped whenever the encoding or the semantics of the
+// instructions change, such that objects built for an older instruction set
+// are rejected rather than executed differently.
+const ObjectVersion = 5
+
+// objectMagic identifies TinyVM object files.
+var objectMagic = []byte("TVMO")
+
+// objectHeaderSize is the size of the object header in bytes.
+const objectHeaderSize = 20
+
+// Object is an assembled program as stored in an object file. An object
+// file consists of the following header followed by the code and the
+// data section:
+//
+//	+--------+---------+---------+--------+-------------+-------------+-------------+
+//	| Bytes  | 0 .. 3  | 4 .. 5  | 6 .. 7 | 8 .. 11     | 12 .. 15    | 16 .. 19    |
+//	+--------+---------+---------+--------+-------------+-------------+-------------+
+//	| Field  | magic   | version | flags  | entry point | code length | data length |
+//	+--------+---------+---------+--------+-------------+-------------+-------------+
+//
+// The magic is "TVMO" and all fields are big endian encoded.
+type Object struct {
+	Entry uint32 // address of the first instruction to execute
+	Code  []byte // byte code
+	Data  []byte // data section, loaded in to memory at address 0
+}
+
+// Program is an assembled program together with the addresses of its
+// code labels.
+type Program struct {
+	Object
+	Symbols SymbolTable
+}
+
+// IsObject returns whether data starts with an object header.
+func IsObject(data []byte) bool {
+	return bytes.HasPrefix(data, objectMagic)
+}
+
+// MarshalBinary encodes the object in the object file format.
+func (o *Object) MarshalBinary() ([]byte, error) {
+	if len(o.Code)%4 != 0 {
+		return nil, fmt.Errorf("code length %d is not a multiple of 4", len(o.Code))
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(objectMagic)
+	binary.Write(buf, binary.BigEndian, uint16(ObjectVersion))
+	binary.Write(buf, binary.BigEndian, uint16(0)) // flags (reserved)
+	binary.Write(buf, binary.BigEndian, o.Entry)
+	binary.Write(buf, binary.BigEndian, uint32(len(o.Code)))
+	binary.Write(buf, binary.BigEndian, uint32(len(o.Data)))
+	buf.Write(o.Code)
+	buf.Write(o.Data)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an object in the object file format.
+func (o *Object) UnmarshalBinary(data []byte) error {
+	if !IsObject(data) {
+		return errors.New("not an object file")
+	}
+	if len(data) < 6 {
+		return errors.New("object file: truncated header")
+	}
+	switch version := binary.BigEndian.Uint16(data[4:]); {
+	case version < ObjectVersion:
+		return fmt.Errorf("object file: version %d was built for an older instruction set, reassemble it", version)
+	case version > ObjectVersion:
+		return fmt.Errorf("object file: unsupported version %d", version)
+	}
+	if len(data) < objectHeaderSize {
+		return errors.New("object file: truncated header")
+	}
+	var (
+		headerSize = objectHeaderSize
+		entry      = binary.BigEndian.Uint32(data[8:])
+		codeLen    = binary.BigEndian.Uint32(data[12:])
+		dataLen    = binary.BigEndian.Uint32(data[16:])
+		size       = uint64(len(data) - headerSize)
+	)
+	if size != uint64(codeLen)+uint64(dataLen) {
+		return fmt.Errorf("object file: length mismatch: header says %d bytes of code and %d bytes of data, got %d bytes", codeLen, dataLen, size)
+	}
+	if codeLen%4 != 0 {
+		return fmt.Errorf("object file: code length %d is not a multiple of 4", codeLen)
+	}
+	o.Entry = entry
+	o.Code = append([]byte(nil), data[headerSize:headerSize+int(codeLen)]...)
+	o.Data = nil
+	if dataLen > 0 {
+		o.Data = append([]byte(nil), data[headerSize+int(codeLen):]...)
+	}
+	return nil
+}
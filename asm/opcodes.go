@@ -21,10 +21,18 @@ const (
 	DataProcessing Mode = iota
 	DataTransfer
 	Branching
+	Arithmetic // extended arithmetic (signed division, modulo, multiply-accumulate)
 )
 
+// Op is an operation code. Op codes are numbered per mode; the lower 4 bits
+// are encoded in the instruction and the mode makes up the remaining bits.
 type Op byte
 
+// Mode returns the instruction mode the op code belongs to.
+func (o Op) Mode() Mode {
+	return Mode(o >> 4)
+}
+
 const (
 	// Data processing op codes
 	Mov Op = iota // move data to register
@@ -39,18 +47,41 @@ const (
 	Lsl           // logical shift left (ops1 << ops2)
 	Lsr           // logical shift right (ops1 >> ops2)
 	Cmp
+	Asr  // arithmetic shift right (ops1 >> ops2, sign extended)
+	Ror  // rotate right (ops1 rotated right by ops2)
+	Movw // move 16 bit immediate to register (zero extended)
+	Movt // move 16 bit immediate to the top half of register
+)
 
+const (
 	// Data transfer op codes
-	Ldm Op = iota // Load memory
-	Stm           // Store memory
+	Ldm  Op = 0x10 + iota // Load memory
+	Stm                   // Store memory
+	Push                  // push registers on to the stack
+	Pop                   // pop registers off the stack
+	Ldrb                  // Load byte
+	Strb                  // Store byte
+	Ldrh                  // Load halfword
+	Strh                  // Store halfword
+)
 
-	// Branching op codes
-	Call Op = iota
-	Ret
+const (
+	// Extended arithmetic op codes
+	Sdiv Op = 0x30 + iota // signed division (ops1 / ops2)
+	Mod                   // unsigned remainder (ops1 % ops2)
+	Smod                  // signed remainder (ops1 % ops2)
+	Mla                   // multiply-accumulate (ops1 x ops2 + ops3)
+)
 
-	// Pseudo opcodes
-	Push Op = 64 + iota
-	Pop
+const (
+	// Branching op codes
+	Bl   Op = 0x20 + iota // branch with link (call), lr = return address
+	Ret                   // return to the address in lr (bx lr)
+	Svc                   // supervisor call (calls in to the host)
+	Stop                  // halt execution
+	Blx                   // branch with link to the address in ops1
+	Bx                    // branch to the address in ops1
+	B                     // branch to pc + offset
 )
 
 var OpString = map[string]Op{
@@ -66,19 +97,46 @@ var OpString = map[string]Op{
 	"lsl": Lsl,
 	"lsr": Lsr,
 	"cmp": Cmp,
+	"asr": Asr,
+	"ror": Ror,
+
+	"movw": Movw,
+	"movt": Movt,
+
+	"sdiv": Sdiv,
+	"udiv": Div,
+	"mod":  Mod,
+	"smod": Smod,
+	"mla":  Mla,
 
 	"ldm": Ldm,
 	"stm": Stm,
-
-	"call": Call,
+	"ldr": Ldm,
+	"str": Stm,
+
+	"ldrb": Ldrb,
+	"strb": Strb,
+	"ldrh": Ldrh,
+	"strh": Strh,
+
+	"b":    B,
+	"bl":   Bl,
+	"blx":  Blx,
+	"bx":   Bx,
+	"call": Bl,
 	"ret":  Ret,
-
-	// pseudo codes
+	"svc":  Svc,
+	"stop": Stop,
+	"halt": Stop,
 	"push": Push,
 	"pop":  Pop,
 }
 
-var PseudoOpcodes = map[Op]bool{Push: true, Pop: true}
+// HasSFlag returns whether the op is able to set the condition flags
+// using the S flag.
+func (o Op) HasSFlag() bool {
+	return o.Mode() == DataProcessing || o.Mode() == Arithmetic
+}
 
 func (o Op) String() string {
 	return OpToString[o]
@@ -97,27 +155,54 @@ var OpToString = map[Op]string{
 	Lsl: "lsl",
 	Lsr: "lsr",
 	Cmp: "cmp",
+	Asr: "asr",
+	Ror: "ror",
 
-	Ldm: "ldm",
-	Stm: "stm",
+	Movw: "movw",
+	Movt: "movt",
 
-	Call: "call",
-	Ret:  "ret",
+	Sdiv: "sdiv",
+	Mod:  "mod",
+	Smod: "smod",
+	Mla:  "mla",
 
+	Ldm:  "ldm",
+	Stm:  "stm",
 	Push: "push",
 	Pop:  "pop",
+	Ldrb: "ldrb",
+	Strb: "strb",
+	Ldrh: "ldrh",
+	Strh: "strh",
+
+	B:    "b",
+	Bl:   "bl",
+	Blx:  "blx",
+	Bx:   "bx",
+	Ret:  "ret",
+	Svc:  "svc",
+	Stop: "stop",
 }
 
 type Cond byte
 
 const (
 	NoCond = iota
-	Eq     // equal
-	Ne     // not equal
-	Gt     // greater than
-	Lt     // less than
-	Gte    // greater than or equal
-	Lte    // less than or equal
+	Eq     // equal (Z set)
+	Ne     // not equal (Z clear)
+	Gt     // signed greater than (Z clear and N equals V)
+	Lt     // signed less than (N not equal to V)
+	Gte    // signed greater than or equal (N equals V)
+	Lte    // signed less than or equal (Z set or N not equal to V)
+	Hs     // unsigned higher or same (C set)
+	Lo     // unsigned lower (C clear)
+	Hi     // unsigned higher (C set and Z clear)
+	Ls     // unsigned lower or same (C clear or Z set)
+	Mi     // negative (N set)
+	Pl     // positive or zero (N clear)
+	Vs     // overflow (V set)
+	Vc     // no overflow (V clear)
+	Al     // always
 )
 
 func (c Cond) String() string {
@@ -131,6 +216,21 @@ var StringToCond = map[string]Cond{
 	"lt":  Lt,
 	"gte": Gte,
 	"lte": Lte,
+	"hs":  Hs,
+	"lo":  Lo,
+	"hi":  Hi,
+	"ls":  Ls,
+	"mi":  Mi,
+	"pl":  Pl,
+	"vs":  Vs,
+	"vc":  Vc,
+	"al":  Al,
+
+	// aliases
+	"ge": Gte,
+	"le": Lte,
+	"cs": Hs,
+	"cc": Lo,
 }
 
 var CondToString = map[Cond]string{
@@ -141,4 +241,13 @@ var CondToString = map[Cond]string{
 	Lt:     "lt",
 	Gte:    "gte",
 	Lte:    "lte",
+	Hs:     "hs",
+	Lo:     "lo",
+	Hi:     "hi",
+	Ls:     "ls",
+	Mi:     "mi",
+	Pl:     "pl",
+	Vs:     "vs",
+	Vc:     "vc",
+	Al:     "al",
 }
@@ -42,6 +42,10 @@ const (
 	PC = R15
 )
 
+func (r RegEntry) String() string {
+	return RegToString[r]
+}
+
 var RegToString = map[RegEntry]string{
 	R0:  "r0",
 	R1:  "r1",
@@ -0,0 +1,73 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SymbolTable maps label names to their addresses.
+type SymbolTable map[string]uint32
+
+// Names returns the names of the labels defined at addr in sorted order.
+func (t SymbolTable) Names(addr uint32) []string {
+	var names []string
+	for name, a := range t {
+		if a == addr {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteTo writes the symbol table to w in its text form, one `name address`
+// pair per line ordered by address.
+func (t SymbolTable) WriteTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if t[names[i]] != t[names[j]] {
+			return t[names[i]] < t[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	var written int64
+	for _, name := range names {
+		n, err := fmt.Fprintf(w, "%s %d\n", name, t[name])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadSymbolTable reads a symbol table in the text form written by WriteTo.
+func ReadSymbolTable(r io.Reader) (SymbolTable, error) {
+	var (
+		table   = make(SymbolTable)
+		scanner = bufio.NewScanner(r)
+	)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || !isIdent(fields[0]) {
+			return nil, fmt.Errorf("symbol table line %d: malformed symbol %q", line, scanner.Text())
+		}
+		addr, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("symbol table line %d: invalid address %q", line, fields[1])
+		}
+		table[fields[0]] = uint32(addr)
+	}
+	return table, scanner.Err()
+}
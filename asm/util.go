@@ -1,12 +1,16 @@
 package asm
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 const (
 	labelType      = ":" // label suffix
 	comment        = ";" // comment prefix
 	registerPrefix = "r" // register prefix
 	numberPrefix   = "#" // number prefix
+	literalPrefix  = "=" // literal (ldr rN =value) prefix
 )
 
 // isLabel returns whether s is of type label
@@ -16,7 +20,22 @@ func isLabel(s string) bool {
 
 // isRegister returns whether s is of type register
 func isRegister(s string) bool {
-	return strings.HasPrefix(s, registerPrefix)
+	_, ok := StringToReg[s]
+	return ok
+}
+
+// looksLikeRegister returns whether s is in the form of a register
+// (`r` followed by digits) without necessarily being a valid one.
+func looksLikeRegister(s string) bool {
+	if len(s) < 2 || !strings.HasPrefix(s, registerPrefix) {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 // isImmediate returns whether s is of type immediate
@@ -24,6 +43,86 @@ func isImmediate(s string) bool {
 	return strings.HasPrefix(s, numberPrefix)
 }
 
-func isPseudoInstr(op Op) bool {
-	return PseudoOpcodes[op]
+// isIdent returns whether s is a valid identifier (e.g. a label name)
+func isIdent(s string) bool {
+	if len(s) == 0 || looksLikeRegister(s) {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_' || c == '.':
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseNumber parses s as numeric literal. Besides decimal numbers it
+// accepts hexadecimal (0x), binary (0b) and character ('A') literals.
+// Negative numbers are returned in two's complement and must fit in 32
+// bits signed, positive numbers in 32 bits unsigned. Range errors wrap
+// strconv.ErrRange.
+func parseNumber(s string) (uint32, error) {
+	if strings.HasPrefix(s, "'") {
+		text, err := strconv.Unquote(s)
+		if err != nil {
+			return 0, strconv.ErrSyntax
+		}
+		runes := []rune(text)
+		if len(runes) != 1 {
+			return 0, strconv.ErrSyntax
+		}
+		return uint32(runes[0]), nil
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		base, s = 16, s[2:]
+	case strings.HasPrefix(s, "0b") || strings.HasPrefix(s, "0B"):
+		base, s = 2, s[2:]
+	}
+	// reject signs and underscores, which ParseUint would otherwise accept
+	if len(s) == 0 || strings.ContainsAny(s, "+-_") {
+		return 0, strconv.ErrSyntax
+	}
+	n, err := strconv.ParseUint(s, base, 32)
+	if err != nil {
+		return 0, err.(*strconv.NumError).Err
+	}
+	if neg {
+		if n > 1<<31 {
+			return 0, strconv.ErrRange
+		}
+		return uint32(-int64(n)), nil
+	}
+	return uint32(n), nil
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
 }
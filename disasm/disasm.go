@@ -0,0 +1,132 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package disasm implements a disassembler for TinyVM byte code.
+package disasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/obscuren/tinyvm/asm"
+)
+
+// Disassemble returns the assembly source of the given byte code. The
+// returned source assembles back in to the same byte code.
+func Disassemble(code []byte) (string, error) {
+	return DisassembleSymbols(code, nil)
+}
+
+// DisassembleSymbols disassembles code like Disassemble and uses the
+// symbol table to restore the labels and the label references of
+// branching instructions.
+func DisassembleSymbols(code []byte, symbols asm.SymbolTable) (string, error) {
+	if len(code)%4 != 0 {
+		return "", fmt.Errorf("code length %d is not a multiple of 4", len(code))
+	}
+
+	var out strings.Builder
+	for pc := uint32(0); pc < uint32(len(code)/4); pc++ {
+		for _, name := range symbols.Names(pc) {
+			fmt.Fprintf(&out, "%s:\n", name)
+		}
+
+		raw := binary.BigEndian.Uint32(code[pc*4:])
+		instr := asm.DecodeInstruction(raw)
+
+		// make sure the instruction has an assembly representation,
+		// which isn't the case for arbitrary data.
+		line := instr.String()
+		if bin, err := asm.Assemble(line); err != nil || !bytes.Equal(bin, code[pc*4:pc*4+4]) {
+			return "", fmt.Errorf("pc %d: invalid instruction %#08x", pc, raw)
+		}
+		if label := target(instr, pc, symbols); label != "" {
+			line = line[:strings.LastIndexByte(line, '#')] + label
+		}
+		fmt.Fprintf(&out, "\t%s\n", line)
+	}
+	// labels may point past the last instruction
+	for _, name := range symbols.Names(uint32(len(code) / 4)) {
+		fmt.Fprintf(&out, "%s:\n", name)
+	}
+	return out.String(), nil
+}
+
+// DisassembleObject disassembles the code of obj like DisassembleSymbols
+// followed by its entry point, as .entry directive, and its data section,
+// as .word and .byte directives. The returned source assembles back in to
+// the same object.
+func DisassembleObject(obj *asm.Object, symbols asm.SymbolTable) (string, error) {
+	src, err := DisassembleSymbols(obj.Code, symbols)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	out.WriteString(src)
+	if obj.Entry != 0 {
+		entry := fmt.Sprint(obj.Entry)
+		if names := symbols.Names(obj.Entry); len(names) > 0 {
+			entry = names[0]
+		}
+		fmt.Fprintf(&out, "\t.entry\t%s\n", entry)
+	}
+	if len(obj.Data) == 0 {
+		return out.String(), nil
+	}
+
+	out.WriteString(".data\n")
+	data := obj.Data
+	for len(data) >= 4 {
+		n := min(len(data)/4, wordsPerLine)
+		words := make([]string, n)
+		for i := range words {
+			words[i] = fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(data[i*4:]))
+		}
+		fmt.Fprintf(&out, "\t.word\t%s\n", strings.Join(words, ", "))
+		data = data[n*4:]
+	}
+	if len(data) > 0 {
+		values := make([]string, len(data))
+		for i, b := range data {
+			values[i] = fmt.Sprintf("0x%02x", b)
+		}
+		fmt.Fprintf(&out, "\t.byte\t%s\n", strings.Join(values, ", "))
+	}
+	return out.String(), nil
+}
+
+// wordsPerLine is the number of data words listed per .word directive.
+const wordsPerLine = 4
+
+// target returns the label the instruction at pc branches to, if any.
+func target(instr asm.Instruction, pc uint32, symbols asm.SymbolTable) string {
+	if !instr.Immediate {
+		return ""
+	}
+	addr := instr.Value
+	switch {
+	case instr.Op == asm.B, instr.Op == asm.Bl:
+		addr += pc
+	case instr.Op == asm.Mov && instr.Dst == asm.PC:
+	default:
+		return ""
+	}
+	if names := symbols.Names(addr); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
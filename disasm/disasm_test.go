@@ -0,0 +1,116 @@
+package disasm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/obscuren/tinyvm/asm"
+)
+
+func TestRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("../examples/*.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []string{
+		"subseq r0 r0 #1\nmovsne r1 r2\nmovgte r15 #4\nlsls r3 r3 r4",
+		"svc #3\nsvc #4097\nstop r2\nstop\nstop #1\ncmp r0 r1\nret",
+		"bl #2\nblxeq r4\nbx lr\nbxne r0",
+		"b #-1\nbeq #3\nb #0\nblt #524287\nbgt #-524288",
+		"mov r0 #260\nldm r1 #1020\nstm r1 r2\npush r0\npop r1",
+		"push {r4-r7, lr}\npopeq {r4-r7, pc}\npush {r0, r1, r3}\npop {r0-r12, r14, r15}",
+		"ldrb r0 r1\nstrb r0 #1020\nldrheq r2 r3\nstrh r2 #64",
+		"ldm r0 [r1, #4]\nstm r0 [r1, #-512]!\nldrb r2 [r3], #511\nstrh r2 [r3, r4]\nldmeq r0 [r1, r2]!\nstr r0 [r1], r2\nldr r0 [r1, #0]",
+		"sdiv r0 r1 r2\nmla r0 r1 r2 r3\nasrs r1 r1 #2\nror r0 r0 r1\nmod r0 r0 #3\nsmodne r1 r1 r2",
+		"mov r0 #257\nmovseq r1 #4294967295\nldr r2 =305419896\nmovw r3 #65535\nmovt r3 #1",
+		".equ SIZE 4\nmov r0 #(SIZE*4+1)\nadd r1 r1 #SIZE-5\nldr r2 =end+1\nend:",
+	}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, string(src))
+	}
+
+	for i, src := range sources {
+		code, symbols, err := asm.AssembleWithSymbols(src)
+		if err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		for _, syms := range []asm.SymbolTable{nil, symbols} {
+			out, err := DisassembleSymbols(code, syms)
+			if err != nil {
+				t.Errorf("%d failed: %v", i, err)
+				continue
+			}
+			reassembled, err := asm.Assemble(out)
+			if err != nil {
+				t.Errorf("%d failed: %v\n%s", i, err, out)
+				continue
+			}
+			if !bytes.Equal(code, reassembled) {
+				t.Errorf("%d failed: code mismatch\n%s", i, out)
+			}
+		}
+	}
+}
+
+func TestDisassembleSymbols(t *testing.T) {
+	code, symbols, err := asm.AssembleWithSymbols("\tmov r15 main\nadd:\n\tadd r0 r0 r1\n\tret\nmain:\n\tcall add\n\tbne main\nend:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := DisassembleSymbols(code, symbols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "\tmov r15 main\nadd:\n\tadd r0 r0 r1\n\tret\nmain:\n\tbl add\n\tbne main\nend:\n"
+	if out != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, out)
+	}
+}
+
+func TestDisassembleObject(t *testing.T) {
+	for i, src := range []string{
+		"mov r0 #1",
+		".entry main\n\tstop\nmain:\n\tldr r1 =count\n\tldm r0 r1\n.data\ncount: .word 42, 7, 1, 2, 3\nmsg: .string \"hi\"",
+		".entry 1\nmov r0 #1\nmov r0 #2\n.data\n.byte 1, 2",
+	} {
+		obj, symbols, err := asm.AssembleObject(src)
+		if err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		for _, syms := range []asm.SymbolTable{nil, symbols} {
+			out, err := DisassembleObject(obj, syms)
+			if err != nil {
+				t.Errorf("%d failed: %v", i, err)
+				continue
+			}
+			reassembled, _, err := asm.AssembleObject(out)
+			if err != nil {
+				t.Errorf("%d failed: %v\n%s", i, err, out)
+				continue
+			}
+			if reassembled.Entry != obj.Entry || !bytes.Equal(reassembled.Code, obj.Code) || !bytes.Equal(reassembled.Data, obj.Data) {
+				t.Errorf("%d failed: object mismatch\n%s", i, out)
+			}
+		}
+	}
+}
+
+func TestDisassembleInvalid(t *testing.T) {
+	for i, code := range [][]byte{
+		{0xff, 0xff, 0xff},
+		{0xff, 0xff, 0xff, 0xff},
+		{0x00, 0x00, 0x00, 0x01}, // unused bits set
+	} {
+		if _, err := Disassemble(code); err == nil {
+			t.Errorf("%d failed: expected error", i)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-	mov r15 main
+	b main
 set:
 	mov r0 #1
 	ret
@@ -1,4 +1,4 @@
 	mov	r1 #10
 loop:
 	subs	r1 r1 #1
-	movne	r15 loop
+	bne	loop
@@ -18,9 +18,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/obscuren/tinyvm/asm"
+	"github.com/obscuren/tinyvm/disasm"
 	"github.com/obscuren/tinyvm/vm"
 )
 
@@ -30,6 +35,9 @@ var (
 	printCode   = flag.Bool("printcode", false, "prints executing code in hex")
 	debug       = flag.Bool("debug", false, "prints debug information during execution")
 	assemble    = flag.Bool("assemble", false, "assembles the given .asm to an object file")
+	symbols     = flag.Bool("symbols", false, "writes the symbol table of the assembled file to a .sym file next to the object file")
+	entryFlag   = flag.String("entry", "", "label or address of the entry point of the assembled object file")
+	moduleFlag  = flag.Bool("module", false, "assembles the given .asm to a relocatable module for tinyvm link (with -assemble)")
 )
 
 func main() {
@@ -40,33 +48,100 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.Arg(0) == "disasm" {
+		if err := disassemble(flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "link" {
+		if err := link(flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *assemble && *moduleFlag {
+		if err := assembleModule(flag.Args()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	var (
-		code []byte
-		err  error
+		code  []byte
+		data  []byte
+		entry uint32
+		err   error
 	)
 	if len(flag.Args()) > 0 {
-		var err error
+		var (
+			err  error
+			syms asm.SymbolTable
+		)
 		code, err = os.ReadFile(flag.Args()[0])
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
-		code, err = asm.Assemble(string(code))
-		if err != nil {
-			fmt.Println(err)
+		// object files are executed directly, anything else is
+		// considered to be assembly source code.
+		if asm.IsModule(code) {
+			fmt.Printf("%s is a relocatable module, link it first (tinyvm link)\n", flag.Args()[0])
 			os.Exit(1)
 		}
+		if asm.IsObject(code) {
+			if *assemble {
+				fmt.Printf("%s is already assembled\n", flag.Args()[0])
+				os.Exit(1)
+			}
+			var obj asm.Object
+			if err := obj.UnmarshalBinary(code); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			code, data, entry = obj.Code, obj.Data, obj.Entry
+		} else {
+			obj, symbols, err := asm.AssembleFS(osFS{}, flag.Args()[0], includePaths...)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			code, data, entry, syms = obj.Code, obj.Data, obj.Entry, symbols
+		}
 
 		if *assemble {
 			outPath := "out.obj"
-			if (len(flag.Args()) > 1) {
+			if len(flag.Args()) > 1 {
 				outPath = flag.Args()[1]
 			}
-			if err := os.WriteFile(outPath, code, 0o600); err != nil {
+			// -entry overrides the entry point set by .entry
+			if *entryFlag != "" {
+				if entry, err = parseEntry(*entryFlag, syms); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+			obj, err := (&asm.Object{Entry: entry, Code: code, Data: data}).MarshalBinary()
+			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
+			if err := os.WriteFile(outPath, obj, 0o600); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if *symbols {
+				if err := writeSymbols(symPath(outPath), syms); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
 			fmt.Printf("%s file successfully assembled: %s\n", flag.Args()[0], outPath)
 			os.Exit(0)
 		}
@@ -91,9 +166,21 @@ func main() {
 	}
 
 	v := vm.New(*debug)
-	for i, registerFlag := range registerFlags {
-		v.Set(asm.Reg, uint32(i), uint32(*registerFlag))
+	if err := v.LoadData(data); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	// start at the entry point unless the pc is set explicitly. Only the
+	// registers given on the command line are set, which leaves the stack
+	// pointer and link register at their initial values.
+	v.Set(asm.Reg, asm.PC, entry)
+	flag.Visit(func(f *flag.Flag) {
+		for i := range registerFlags {
+			if f.Name == fmt.Sprintf("r%d", i) {
+				v.Set(asm.Reg, uint32(i), uint32(*registerFlags[i]))
+			}
+		}
+	})
 
 	if err := v.Exec(code); err != nil {
 		fmt.Println("err", err)
@@ -105,11 +192,194 @@ func main() {
 	}
 
 	fmt.Println(v.Get(asm.Reg, asm.R0))
+
+	// use the exit code of stop as the exit status
+	if exitCode, halted := v.ExitCode(); halted {
+		os.Exit(int(exitCode))
+	}
+}
+
+// disassemble implements the `tinyvm disasm file.obj [file.sym]` command. The
+// symbol table defaults to the .sym file next to the object file, if any.
+func disassemble(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: tinyvm disasm file.obj [file.sym]")
+	}
+	code, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	obj := &asm.Object{Code: code}
+	if asm.IsObject(code) {
+		if err := obj.UnmarshalBinary(code); err != nil {
+			return err
+		}
+	}
+
+	path := symPath(args[0])
+	if len(args) > 1 {
+		path = args[1]
+	}
+	var syms asm.SymbolTable
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		if syms, err = asm.ReadSymbolTable(f); err != nil {
+			return err
+		}
+	} else if len(args) > 1 {
+		return err
+	}
+
+	src, err := disasm.DisassembleObject(obj, syms)
+	if err != nil {
+		return err
+	}
+	fmt.Print(src)
+	return nil
+}
+
+// assembleModule implements `tinyvm -assemble -module file.asm [file.o]`,
+// which assembles a relocatable module.
+func assembleModule(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: tinyvm -assemble -module file.asm [file.o]")
+	}
+	m, err := asm.AssembleModuleFS(osFS{}, args[0], includePaths...)
+	if err != nil {
+		return err
+	}
+	outPath := strings.TrimSuffix(args[0], filepath.Ext(args[0])) + ".o"
+	if len(args) > 1 {
+		outPath = args[1]
+	}
+	bin, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(outPath, bin, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("%s module successfully assembled: %s\n", args[0], outPath)
+	return nil
 }
 
-var registerFlags [asm.MaxRegister]*int
+// link implements the `tinyvm link [-o out.obj] [-entry label] [-symbols]
+// files...` command, which links modules in to an object file. Source files
+// are assembled as module first.
+func link(args []string) error {
+	var (
+		flags   = flag.NewFlagSet("link", flag.ContinueOnError)
+		outPath = flags.String("o", "out.obj", "path of the linked object file")
+		entry   = flags.String("entry", "", "label or address of the entry point")
+		symbols = flags.Bool("symbols", false, "writes the symbol table of the exported labels to a .sym file next to the object file")
+	)
+	flags.Var(&includePaths, "I", "adds a directory to the include path of .include (may be repeated)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: tinyvm link [-o out.obj] [-entry label] [-symbols] files...")
+	}
+
+	var modules []*asm.Module
+	for _, path := range flags.Args() {
+		code, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m := new(asm.Module)
+		if asm.IsModule(code) {
+			err = m.UnmarshalBinary(code)
+		} else {
+			m, err = asm.AssembleModuleFS(osFS{}, path, includePaths...)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		m.Name = path
+		modules = append(modules, m)
+	}
+
+	obj, syms, err := asm.Link(modules...)
+	if err != nil {
+		return err
+	}
+	if obj.Entry, err = parseEntry(*entry, syms); err != nil {
+		return err
+	}
+	bin, err := obj.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*outPath, bin, 0o600); err != nil {
+		return err
+	}
+	if *symbols {
+		if err := writeSymbols(symPath(*outPath), syms); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%d modules successfully linked: %s\n", len(modules), *outPath)
+	return nil
+}
+
+// parseEntry resolves the entry point given by the -entry flag, which is
+// either a label or an address.
+func parseEntry(entry string, syms asm.SymbolTable) (uint32, error) {
+	if entry == "" {
+		return 0, nil
+	}
+	if addr, ok := syms[entry]; ok {
+		return addr, nil
+	}
+	addr, err := strconv.ParseUint(entry, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid entry point %q: no such label", entry)
+	}
+	return uint32(addr), nil
+}
+
+// symPath returns the path of the symbol table belonging to an object file.
+func symPath(objPath string) string {
+	return strings.TrimSuffix(objPath, filepath.Ext(objPath)) + ".sym"
+}
+
+// writeSymbols writes the symbol table to the given path.
+func writeSymbols(path string, syms asm.SymbolTable) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := syms.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// osFS is a file system opening files by their operating system path, which
+// allows the assembled file and its includes to be located anywhere.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) { return os.Open(name) }
+
+// stringsFlag is a flag which may be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var (
+	registerFlags [asm.MaxRegister]*int
+	includePaths  stringsFlag
+)
 
 func init() {
+	flag.Var(&includePaths, "I", "adds a directory to the include path of .include (may be repeated)")
 	for i := 0; i < asm.MaxRegister; i++ {
 		registerFlags[i] = flag.Int(fmt.Sprintf("r%d", i), 0, fmt.Sprintf("sets the r%d register", i))
 	}
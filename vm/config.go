@@ -0,0 +1,101 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"io"
+	"maps"
+	"os"
+
+	"github.com/obscuren/tinyvm/asm"
+)
+
+// Config are the configuration options of the VM. The zero value
+// is a valid configuration and yields the same VM as New(false).
+type Config struct {
+	// MemorySize is the size of the memory in words. Defaults
+	// to StackSize.
+	MemorySize int
+	// StackBase is the initial value of the stack pointer (r13).
+	// Defaults to the last word of the memory if nil. The stack
+	// grows down and is empty when the stack pointer equals StackBase.
+	// A base beyond the memory is clamped to MemorySize.
+	StackBase *uint32
+	// StackLimit is the lowest address the stack may grow to.
+	// Pushing below it raises a StackFault. Defaults to 0 and is
+	// clamped to StackBase.
+	StackLimit uint32
+	// Registers is the initial register file. The stack pointer
+	// is always initialised to StackBase and the link register (r14)
+	// defaults to ExitAddress.
+	Registers [asm.MaxRegister]uint32
+
+	// Debug enables printing of debug information during execution.
+	Debug bool
+	// Trace is the destination of the debug information. Defaults
+	// to os.Stdout.
+	Trace io.Writer
+
+	// GasLimit is the amount of gas each execution may consume
+	// (0 = unmetered).
+	GasLimit uint64
+	// GasTable overrides the opcode costs. Defaults to DefaultGasTable.
+	// The table is copied by NewWithConfig.
+	GasTable GasTable
+}
+
+// NewWithConfig returns a new VM initialised according to cfg.
+func NewWithConfig(cfg Config) *VM {
+	if cfg.MemorySize <= 0 {
+		cfg.MemorySize = StackSize
+	}
+	stackBase := uint32(cfg.MemorySize - 1)
+	if cfg.StackBase != nil {
+		stackBase = *cfg.StackBase
+	}
+	// an empty stack may start just past the end of the memory
+	if uint64(stackBase) > uint64(cfg.MemorySize) {
+		stackBase = uint32(cfg.MemorySize)
+	}
+	if cfg.StackLimit > stackBase {
+		cfg.StackLimit = stackBase
+	}
+	if cfg.Trace == nil {
+		cfg.Trace = os.Stdout
+	}
+	if cfg.GasTable == nil {
+		cfg.GasTable = DefaultGasTable
+	}
+
+	vm := &VM{
+		registers:  cfg.Registers,
+		memory:     make([]uint32, cfg.MemorySize),
+		stackBase:  stackBase,
+		stackLimit: cfg.StackLimit,
+		gasLimit:   cfg.GasLimit,
+		gasTable:   maps.Clone(cfg.GasTable),
+		debug:      cfg.Debug,
+		trace:      cfg.Trace,
+
+		syscalls:     make(map[uint32]*syscall),
+		syscallNames: make(map[string]uint32),
+	}
+	vm.Set(asm.Reg, asm.SP, stackBase)
+	if cfg.Registers[asm.LR] == 0 {
+		vm.Set(asm.Reg, asm.LR, ExitAddress)
+	}
+	return vm
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import "fmt"
+
+// ExecError is returned when the execution of a program is interrupted.
+// It records the state of the program at the point of interruption.
+type ExecError struct {
+	PC    uint32 // program counter of the instruction about to be executed
+	Steps uint64 // number of instructions executed before the interruption
+	Err   error  // cause of the interruption
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("execution interrupted (pc=%d steps=%d): %v", e.PC, e.Steps, e.Err)
+}
+
+// Unwrap returns the cause of the interruption.
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Access is the kind of memory access.
+type Access byte
+
+const (
+	MemRead  Access = iota // memory read (ldm, ldrb, ldrh)
+	MemWrite               // memory write (stm, strb, strh)
+)
+
+func (a Access) String() string {
+	switch a {
+	case MemRead:
+		return "read"
+	case MemWrite:
+		return "write"
+	}
+	return fmt.Sprintf("access(%d)", byte(a))
+}
+
+// MemoryFault is returned when a program accesses memory outside of the
+// bounds of the memory of the VM.
+type MemoryFault struct {
+	Addr   uint32 // faulting address, a byte address for byte and halfword accesses
+	Access Access // kind of memory access
+	PC     uint32 // program counter of the faulting instruction
+	Instr  uint32 // raw faulting instruction (0 for ReadMemory and WriteMemory)
+}
+
+func (e *MemoryFault) Error() string {
+	return fmt.Sprintf("memory fault: %s of address %d out of bounds (pc=%d instr=%#08x)", e.Access, e.Addr, e.PC, e.Instr)
+}
+
+// StackFaultKind is the kind of stack fault.
+type StackFaultKind byte
+
+const (
+	StackOverflow  StackFaultKind = iota // push below the stack limit
+	StackUnderflow                       // pop above the stack base
+)
+
+func (k StackFaultKind) String() string {
+	switch k {
+	case StackOverflow:
+		return "overflow"
+	case StackUnderflow:
+		return "underflow"
+	}
+	return fmt.Sprintf("stackfault(%d)", byte(k))
+}
+
+// StackFault is returned when a push or pop moves the stack pointer
+// outside of the bounds of the stack, StackLimit to StackBase.
+type StackFault struct {
+	Kind  StackFaultKind // overflow or underflow
+	SP    uint32         // stack pointer before the faulting instruction
+	PC    uint32         // program counter of the faulting instruction
+	Instr uint32         // raw faulting instruction
+}
+
+func (e *StackFault) Error() string {
+	return fmt.Sprintf("stack %s: sp=%d (pc=%d instr=%#08x)", e.Kind, e.SP, e.PC, e.Instr)
+}
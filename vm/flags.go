@@ -0,0 +1,170 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"math/bits"
+
+	"github.com/obscuren/tinyvm/asm"
+)
+
+// Flags is the status register. Like ARM's CPSR the condition flags
+// are kept in the upper 4 bits.
+type Flags uint32
+
+const (
+	FlagV Flags = 1 << (28 + iota) // overflow
+	FlagC                          // carry (or not borrow)
+	FlagZ                          // zero
+	FlagN                          // negative
+)
+
+// String returns the flags in NZCV form where set flags are upper case
+// and cleared flags lower case (e.g. nZCv).
+func (f Flags) String() string {
+	str := []byte("nzcv")
+	for i, flag := range []Flags{FlagN, FlagZ, FlagC, FlagV} {
+		if f&flag != 0 {
+			str[i] -= 'a' - 'A'
+		}
+	}
+	return string(str)
+}
+
+// Flags returns the status register of the VM.
+func (vm *VM) Flags() Flags {
+	return vm.flags
+}
+
+// setFlags sets the N and Z flags based on the result and the C and V
+// flags as given.
+func (vm *VM) setFlags(result uint32, carry, overflow bool) {
+	var flags Flags
+	if result&(1<<31) != 0 {
+		flags |= FlagN
+	}
+	if result == 0 {
+		flags |= FlagZ
+	}
+	if carry {
+		flags |= FlagC
+	}
+	if overflow {
+		flags |= FlagV
+	}
+	vm.flags = flags
+}
+
+// condition reports whether the condition holds for the current flags.
+func (vm *VM) condition(cond asm.Cond) bool {
+	var (
+		n = vm.flags&FlagN != 0
+		z = vm.flags&FlagZ != 0
+		c = vm.flags&FlagC != 0
+		v = vm.flags&FlagV != 0
+	)
+	switch cond {
+	case asm.Eq:
+		return z
+	case asm.Ne:
+		return !z
+	case asm.Hs:
+		return c
+	case asm.Lo:
+		return !c
+	case asm.Mi:
+		return n
+	case asm.Pl:
+		return !n
+	case asm.Vs:
+		return v
+	case asm.Vc:
+		return !v
+	case asm.Hi:
+		return c && !z
+	case asm.Ls:
+		return !c || z
+	case asm.Gte:
+		return n == v
+	case asm.Lt:
+		return n != v
+	case asm.Gt:
+		return !z && n == v
+	case asm.Lte:
+		return z || n != v
+	}
+	// NoCond and Al
+	return true
+}
+
+// add returns a + b along with the carry and signed overflow.
+func add(a, b uint32) (result uint32, carry, overflow bool) {
+	result, c := bits.Add32(a, b, 0)
+	return result, c == 1, (a^result)&(b^result)>>31 == 1
+}
+
+// sub returns a - b along with the carry (set if no borrow occurred)
+// and signed overflow.
+func sub(a, b uint32) (result uint32, carry, overflow bool) {
+	result = a - b
+	return result, a >= b, (a^b)&(a^result)>>31 == 1
+}
+
+// lsl returns a << n along with the last bit shifted out. The carry is
+// left unchanged if n is zero.
+func lsl(a, n uint32, carry bool) (uint32, bool) {
+	switch {
+	case n == 0:
+		return a, carry
+	case n <= 32:
+		return a << n, a>>(32-n)&1 == 1
+	}
+	return 0, false
+}
+
+// lsr returns a >> n along with the last bit shifted out. The carry is
+// left unchanged if n is zero.
+func lsr(a, n uint32, carry bool) (uint32, bool) {
+	switch {
+	case n == 0:
+		return a, carry
+	case n <= 32:
+		return a >> n, a>>(n-1)&1 == 1
+	}
+	return 0, false
+}
+
+// asr returns a >> n, filled with the sign bit, along with the last bit
+// shifted out. The carry is left unchanged if n is zero.
+func asr(a, n uint32, carry bool) (uint32, bool) {
+	switch {
+	case n == 0:
+		return a, carry
+	case n < 32:
+		return uint32(int32(a) >> n), a>>(n-1)&1 == 1
+	}
+	return uint32(int32(a) >> 31), a>>31 == 1
+}
+
+// ror returns a rotated right by n along with the last bit rotated out.
+// The carry is left unchanged if n is zero.
+func ror(a, n uint32, carry bool) (uint32, bool) {
+	if n == 0 {
+		return a, carry
+	}
+	result := bits.RotateLeft32(a, -int(n%32))
+	return result, result>>31 == 1
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"maps"
+
+	"github.com/obscuren/tinyvm/asm"
+)
+
+// ErrOutOfGas is returned by Exec when executing the next instruction
+// would exceed the gas limit.
+var ErrOutOfGas = errors.New("out of gas")
+
+// DefaultGasCost is the cost of any opcode missing from the gas table.
+const DefaultGasCost = 1
+
+// GasTable maps opcodes to the amount of gas it costs to execute them.
+type GasTable map[asm.Op]uint64
+
+// DefaultGasTable contains the default opcode costs used by the VM. Each
+// VM uses a copy, changes to the table only affect VMs created afterwards.
+var DefaultGasTable = GasTable{
+	asm.Mov:  1,
+	asm.Add:  1,
+	asm.Sub:  1,
+	asm.Rsb:  1,
+	asm.Mul:  3,
+	asm.Div:  5,
+	asm.And:  1,
+	asm.Xor:  1,
+	asm.Orr:  1,
+	asm.Lsl:  1,
+	asm.Lsr:  1,
+	asm.Cmp:  1,
+	asm.Asr:  1,
+	asm.Ror:  1,
+	asm.Movw: 1,
+	asm.Movt: 1,
+
+	asm.Sdiv: 5,
+	asm.Mod:  5,
+	asm.Smod: 5,
+	asm.Mla:  4,
+
+	asm.Ldm:  3,
+	asm.Stm:  3,
+	asm.Push: 3,
+	asm.Pop:  3,
+	asm.Ldrb: 3,
+	asm.Strb: 3,
+	asm.Ldrh: 3,
+	asm.Strh: 3,
+
+	asm.B:    1,
+	asm.Bl:   2,
+	asm.Blx:  2,
+	asm.Bx:   2,
+	asm.Ret:  2,
+	asm.Svc:  10,
+	asm.Stop: 1,
+}
+
+// cost returns the gas cost of op. Opcodes without an entry in the
+// table cost DefaultGasCost.
+func (t GasTable) cost(op asm.Op) uint64 {
+	if cost, ok := t[op]; ok {
+		return cost
+	}
+	return DefaultGasCost
+}
+
+// SetGasLimit sets the amount of gas each call to Exec may consume.
+// A limit of zero disables metering.
+func (vm *VM) SetGasLimit(limit uint64) {
+	vm.gasLimit = limit
+}
+
+// SetGasTable overrides the opcode costs. Opcodes missing from table
+// cost DefaultGasCost. The table is copied, such that later changes to it
+// don't affect the VM.
+func (vm *VM) SetGasTable(table GasTable) {
+	vm.gasTable = maps.Clone(table)
+}
+
+// GasUsed returns the amount of gas consumed by the last execution.
+func (vm *VM) GasUsed() uint64 {
+	return vm.gasUsed
+}
+
+// useGas charges the cost of op against the gas limit and returns
+// ErrOutOfGas if the limit would be exceeded.
+func (vm *VM) useGas(op asm.Op) error {
+	cost := vm.gasTable.cost(op)
+	if vm.gasLimit > 0 && vm.gasLimit-vm.gasUsed < cost {
+		vm.gasUsed = vm.gasLimit
+		return ErrOutOfGas
+	}
+	vm.gasUsed += cost
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/obscuren/tinyvm/asm"
+)
+
+// MaxCallArgs is the maximum number of arguments passed by Call, which are
+// passed in r0 to r3.
+const MaxCallArgs = 4
+
+// ErrNoProgram is returned when calling in to a VM without a program.
+var ErrNoProgram = errors.New("no program loaded")
+
+// Load loads the program in to the VM. The data section is copied in to
+// memory and the program counter is set to the entry point, such that the
+// program can be executed by Run or its labels called by Call.
+func (vm *VM) Load(p *asm.Program) error {
+	if err := vm.LoadData(p.Data); err != nil {
+		return err
+	}
+	vm.program = p
+	vm.Set(asm.Reg, asm.PC, p.Entry)
+	return nil
+}
+
+// Run executes the loaded program starting at the program counter.
+func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext executes the loaded program like Run, but stops once ctx is
+// cancelled or its deadline expires.
+func (vm *VM) RunContext(ctx context.Context) error {
+	if vm.program == nil {
+		return ErrNoProgram
+	}
+	return vm.ExecContext(ctx, vm.program.Code)
+}
+
+// Symbol returns the address of the code label name of the loaded program.
+func (vm *VM) Symbol(name string) (uint32, bool) {
+	if vm.program == nil {
+		return 0, false
+	}
+	addr, ok := vm.program.Symbols[name]
+	return addr, ok
+}
+
+// Call calls the code label name of the loaded program as function. The
+// arguments are passed in r0 to r3 and the link register is set to
+// ExitAddress, such that the function runs until it returns, after which
+// its result is taken from r0. A stop instruction also ends the call. The
+// program counter and link register are restored afterwards, such that
+// Run continues where it was before the call.
+func (vm *VM) Call(name string, args ...uint32) (uint32, error) {
+	return vm.CallContext(context.Background(), name, args...)
+}
+
+// CallContext calls a function like Call, but stops once ctx is cancelled
+// or its deadline expires.
+func (vm *VM) CallContext(ctx context.Context, name string, args ...uint32) (uint32, error) {
+	if vm.program == nil {
+		return 0, ErrNoProgram
+	}
+	addr, ok := vm.program.Symbols[name]
+	if !ok {
+		return 0, fmt.Errorf("call %s: undefined symbol %q", name, name)
+	}
+	if len(args) > MaxCallArgs {
+		return 0, fmt.Errorf("call %s: too many arguments: expected at most %d, got %d", name, MaxCallArgs, len(args))
+	}
+	for i, arg := range args {
+		vm.Set(asm.Reg, uint32(asm.R0)+uint32(i), arg)
+	}
+	pc, lr := vm.Get(asm.Reg, asm.PC), vm.Get(asm.Reg, asm.LR)
+	defer func() {
+		vm.Set(asm.Reg, asm.PC, pc)
+		vm.Set(asm.Reg, asm.LR, lr)
+	}()
+	vm.Set(asm.Reg, asm.LR, ExitAddress)
+	vm.Set(asm.Reg, asm.PC, addr)
+	if err := vm.ExecContext(ctx, vm.program.Code); err != nil {
+		return 0, err
+	}
+	return vm.Get(asm.Reg, asm.R0), nil
+}
@@ -1 +1,72 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
 package vm
+
+import (
+	"math/bits"
+
+	"github.com/obscuren/tinyvm/asm"
+)
+
+// push stores the register list of instr on the stack. The stack is full
+// descending: the stack pointer is decremented by the number of registers
+// and the lowest register is stored at the lowest address.
+func (vm *VM) push(instr asm.Instruction, pc uint32) error {
+	var (
+		sp = vm.registers[asm.SP]
+		n  = uint32(bits.OnesCount16(instr.Regs))
+	)
+	if sp < n || sp-n < vm.stackLimit {
+		return &StackFault{Kind: StackOverflow, SP: sp, PC: pc, Instr: instr.Raw}
+	}
+	addr := sp - n
+	if err := vm.checkMem(sp-1, MemWrite, pc, instr); err != nil {
+		return err
+	}
+	for reg := uint32(0); reg < asm.MaxRegister; reg++ {
+		if instr.Regs&(1<<reg) != 0 {
+			vm.memory[addr] = vm.registers[reg]
+			addr++
+		}
+	}
+	vm.registers[asm.SP] = sp - n
+	return nil
+}
+
+// pop loads the register list of instr from the stack in ascending order
+// and increments the stack pointer by the number of registers. Popping in
+// to the program counter branches to the popped address.
+func (vm *VM) pop(instr asm.Instruction, pc uint32) error {
+	var (
+		sp = vm.registers[asm.SP]
+		n  = uint32(bits.OnesCount16(instr.Regs))
+	)
+	if uint64(sp)+uint64(n) > uint64(vm.stackBase) {
+		return &StackFault{Kind: StackUnderflow, SP: sp, PC: pc, Instr: instr.Raw}
+	}
+	if err := vm.checkMem(sp+n-1, MemRead, pc, instr); err != nil {
+		return err
+	}
+	addr := sp
+	for reg := uint32(0); reg < asm.MaxRegister; reg++ {
+		if instr.Regs&(1<<reg) != 0 {
+			vm.registers[reg] = vm.memory[addr]
+			addr++
+		}
+	}
+	vm.registers[asm.SP] = sp + n
+	return nil
+}
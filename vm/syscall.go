@@ -0,0 +1,74 @@
+// Copyright 2016 Jeffrey Wilcke
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import "fmt"
+
+// SyscallFunc is a host function which can be called by a program using
+// the svc instruction. The function has access to the registers through Get
+// and Set and to the memory through ReadMemory and WriteMemory, which return
+// a *MemoryFault for addresses outside of the memory rather than panicking.
+// Returning an error aborts the execution.
+type SyscallFunc func(vm *VM) error
+
+// syscall is a registered host function.
+type syscall struct {
+	name string
+	fn   SyscallFunc
+}
+
+// UnknownSyscallError is returned when a program calls a syscall number
+// which has not been registered.
+type UnknownSyscallError struct {
+	Num uint32 // syscall number
+	PC  uint32 // program counter of the svc instruction
+}
+
+func (e *UnknownSyscallError) Error() string {
+	return fmt.Sprintf("unknown syscall %d (pc=%d)", e.Num, e.PC)
+}
+
+// RegisterSyscall registers fn as syscall number num. Programs call it
+// using `svc #num`. The name can be used to look up the syscall number
+// and is used for error reporting. Registering a number twice replaces
+// the previous function.
+func (vm *VM) RegisterSyscall(num uint32, name string, fn SyscallFunc) {
+	// the previous name may have been registered again under another number
+	if prev, ok := vm.syscalls[num]; ok && vm.syscallNames[prev.name] == num {
+		delete(vm.syscallNames, prev.name)
+	}
+	vm.syscalls[num] = &syscall{name: name, fn: fn}
+	vm.syscallNames[name] = num
+}
+
+// SyscallNumber returns the number under which the syscall with the
+// given name has been registered.
+func (vm *VM) SyscallNumber(name string) (uint32, bool) {
+	num, ok := vm.syscallNames[name]
+	return num, ok
+}
+
+// syscall calls the host function registered under num.
+func (vm *VM) syscall(num, pc uint32) error {
+	call, ok := vm.syscalls[num]
+	if !ok {
+		return &UnknownSyscallError{Num: num, PC: pc}
+	}
+	if err := call.fn(vm); err != nil {
+		return fmt.Errorf("syscall %s (%d): %w", call.name, num, err)
+	}
+	return nil
+}
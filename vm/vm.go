@@ -17,8 +17,10 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"unicode"
 
 	"github.com/obscuren/tinyvm/asm"
@@ -30,6 +32,14 @@ const (
 	Patch = 1 // Patch version
 
 	StackSize = 1024
+
+	// ExitAddress is the initial value of the link register. Returning
+	// to it ends the execution, like running past the last instruction.
+	ExitAddress = 0xffffffff
+
+	// ctxCheckInterval is the number of instructions executed between
+	// checks of the execution context.
+	ctxCheckInterval = 1024
 )
 
 // VesionString represents the full version, including the name
@@ -42,21 +52,35 @@ type VM struct {
 	registers [asm.MaxRegister]uint32 // general purpose registers
 	memory    []uint32                // memory
 
+	stackBase  uint32 // initial stack pointer, the top of the stack
+	stackLimit uint32 // lowest address of the stack
+
+	gasLimit uint64   // gas available to each execution (0 = unmetered)
+	gasUsed  uint64   // gas consumed by the last execution
+	gasTable GasTable // opcode costs
+
+	syscalls     map[uint32]*syscall // registered host functions
+	syscallNames map[string]uint32   // syscall numbers by name
+
+	flags Flags // condition flags (status register)
+
+	halted   bool   // whether the last execution was halted by stop
+	exitCode uint32 // exit code passed to stop
+
+	program *asm.Program // program loaded by Load
+
 	debug bool
+	trace io.Writer // debug output
 }
 
-// New returns a new initialised VM.
+// New returns a new initialised VM with the default configuration.
 func New(debug bool) *VM {
-	vm := &VM{
-		memory: make([]uint32, StackSize),
-		debug:  debug,
-	}
-	vm.Set(asm.Reg, asm.R13, StackSize-1)
-	return vm
+	return NewWithConfig(Config{Debug: debug})
 }
 
 // Set sets the value to the receivers location. The receiver can be either
-// register or memory.
+// register or memory. Set panics if the location is out of range, addresses
+// controlled by the program should be written using WriteMemory.
 func (vm *VM) Set(typ byte, loc uint32, value uint32) {
 	switch typ {
 	case asm.Reg:
@@ -66,7 +90,9 @@ func (vm *VM) Set(typ byte, loc uint32, value uint32) {
 	}
 }
 
-// Get retrieves the value from the given storage type's location.
+// Get retrieves the value from the given storage type's location. Get panics
+// if the location is out of range, addresses controlled by the program
+// should be read using ReadMemory.
 func (vm *VM) Get(typ byte, loc uint32) uint32 {
 	switch typ {
 	case asm.Reg:
@@ -80,6 +106,116 @@ func (vm *VM) Get(typ byte, loc uint32) uint32 {
 	panic(fmt.Sprintf("vm.Get: invalid get type %d on %d", typ, loc))
 }
 
+// ReadMemory returns the word at address addr or a *MemoryFault if addr lies
+// outside of the memory of the VM. The fault records the current program
+// counter, e.g. that of the svc instruction when called by a syscall.
+func (vm *VM) ReadMemory(addr uint32) (uint32, error) {
+	if uint64(addr) >= uint64(len(vm.memory)) {
+		return 0, &MemoryFault{Addr: addr, Access: MemRead, PC: vm.registers[asm.PC]}
+	}
+	return vm.memory[addr], nil
+}
+
+// WriteMemory sets the word at address addr to value or returns a
+// *MemoryFault like ReadMemory if addr lies outside of the memory.
+func (vm *VM) WriteMemory(addr, value uint32) error {
+	if uint64(addr) >= uint64(len(vm.memory)) {
+		return &MemoryFault{Addr: addr, Access: MemWrite, PC: vm.registers[asm.PC]}
+	}
+	vm.memory[addr] = value
+	return nil
+}
+
+// LoadData copies the data section of an object in to memory starting at
+// address 0. Every 4 bytes are stored big endian in a single word.
+func (vm *VM) LoadData(data []byte) error {
+	if words := (len(data) + 3) / 4; words > len(vm.memory) {
+		return fmt.Errorf("data section of %d bytes exceeds memory of %d words", len(data), len(vm.memory))
+	}
+	for i, b := range data {
+		vm.setByte(uint64(i), b)
+	}
+	return nil
+}
+
+// byteAt returns the byte at byte address addr. Memory is big endian: word
+// n holds the bytes 4n to 4n+3, with byte 4n in its most significant bits.
+func (vm *VM) byteAt(addr uint64) byte {
+	return byte(vm.memory[addr/4] >> (24 - 8*(addr%4)))
+}
+
+// setByte sets the byte at byte address addr.
+func (vm *VM) setByte(addr uint64, b byte) {
+	shift := 24 - 8*(addr%4)
+	vm.memory[addr/4] = vm.memory[addr/4]&^(0xff<<shift) | uint32(b)<<shift
+}
+
+// load returns the size bytes at byte address addr as big endian value.
+// Halfwords need not be aligned.
+func (vm *VM) load(addr uint32, size int, pc uint32, instr asm.Instruction) (uint32, error) {
+	if uint64(addr)+uint64(size) > 4*uint64(len(vm.memory)) {
+		return 0, &MemoryFault{Addr: addr, Access: MemRead, PC: pc, Instr: instr.Raw}
+	}
+	var value uint32
+	for i := 0; i < size; i++ {
+		value = value<<8 | uint32(vm.byteAt(uint64(addr)+uint64(i)))
+	}
+	return value, nil
+}
+
+// store stores the low size bytes of value big endian at byte address addr.
+func (vm *VM) store(addr uint32, size int, value uint32, pc uint32, instr asm.Instruction) error {
+	if uint64(addr)+uint64(size) > 4*uint64(len(vm.memory)) {
+		return &MemoryFault{Addr: addr, Access: MemWrite, PC: pc, Instr: instr.Raw}
+	}
+	for i := 0; i < size; i++ {
+		vm.setByte(uint64(addr)+uint64(i), byte(value>>(8*(size-i-1))))
+	}
+	return nil
+}
+
+// checkMem returns a *MemoryFault if addr lies outside of the memory
+// of the VM.
+func (vm *VM) checkMem(addr uint32, access Access, pc uint32, instr asm.Instruction) error {
+	if uint64(addr) >= uint64(len(vm.memory)) {
+		return &MemoryFault{Addr: addr, Access: access, PC: pc, Instr: instr.Raw}
+	}
+	return nil
+}
+
+// address returns the memory address accessed by the load or store instr.
+// Indexed addresses add the offset, an immediate or Ops2, to the base
+// register Ops1, except for post-indexing which accesses the base itself.
+func (vm *VM) address(instr asm.Instruction) (uint32, error) {
+	switch instr.Addr {
+	case asm.AddrDirect:
+		return getOps1(vm, instr), nil
+	case asm.AddrOffset, asm.AddrPreIndex:
+		return vm.Get(asm.Reg, uint32(instr.Ops1)) + getOps2(vm, instr), nil
+	case asm.AddrPostIndex:
+		return vm.Get(asm.Reg, uint32(instr.Ops1)), nil
+	}
+	return 0, fmt.Errorf("invalid addressing mode: %d", instr.Addr)
+}
+
+// writeback adds the offset to the base register of the pre- and
+// post-indexed addressing modes. Loads in to the base register take
+// precedence over the write back.
+func (vm *VM) writeback(instr asm.Instruction) {
+	if instr.Addr == asm.AddrPreIndex || instr.Addr == asm.AddrPostIndex {
+		vm.Set(asm.Reg, uint32(instr.Ops1), vm.Get(asm.Reg, uint32(instr.Ops1))+getOps2(vm, instr))
+	}
+}
+
+// transferSize returns the size in bytes of the memory accessed by the
+// byte and halfword load and store instructions.
+func transferSize(op asm.Op) int {
+	if op == asm.Ldrh || op == asm.Strh {
+		return 2
+	}
+	return 1
+}
+
 func getOps2(vm *VM, instr asm.Instruction) uint32 {
 	var ops2 uint32
 	if instr.Immediate {
@@ -101,153 +237,233 @@ func getOps1(vm *VM, instr asm.Instruction) uint32 {
 }
 
 // Exec executes the given byte code and returns the status of the
-// program as well as the return value.
+// program as well as the return value. If a gas limit is set, Exec
+// returns ErrOutOfGas once the program has consumed all of its gas.
 func (vm *VM) Exec(code []byte) error {
+	return vm.ExecContext(context.Background(), code)
+}
+
+// ExecContext executes the given byte code like Exec, but stops once ctx
+// is cancelled or its deadline expires. The context is checked periodically
+// and an interruption is reported as an *ExecError wrapping ctx.Err().
+func (vm *VM) ExecContext(ctx context.Context, code []byte) error {
+	vm.gasUsed = 0
+	vm.halted, vm.exitCode = false, 0
+
 	var (
-		callStack        []uint32               // call stack
-		instrPos         = vm.registers[15] * 4 // instruction to read
-		conditionalValue int32                  // condition value used by conditional instructions
+		instrPos = uint64(vm.registers[15]) * 4 // instruction to read
+		steps    uint64                         // number of instructions executed
 	)
 
 	// iterate over the instructions
-	for int(instrPos) < len(code) {
+	for ; instrPos < uint64(len(code)); steps++ {
 		// loop, read and execute each op code
 		pc := vm.registers[15]
 		branch := pc // for branch tracking
 
+		if steps%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return &ExecError{PC: pc, Steps: steps, Err: err}
+			}
+		}
+
+		if uint64(len(code))-instrPos < 4 {
+			return fmt.Errorf("truncated instruction (pc=%d)", pc)
+		}
 		instr := asm.DecodeInstruction(binary.BigEndian.Uint32(code[instrPos : instrPos+4]))
 		if vm.debug {
-			fmt.Printf("instruction: %032b\n", instr.Raw)
-			fmt.Printf("state: cv=%d\n", conditionalValue)
-			fmt.Printf("cond= %s m=%v op=%s (pc=%d) dst=r%v ops1=r%d ops2=r%d I=%v S=%v value=%v\n", instr.Cond, instr.Mode, instr.Op, pc, instr.Dst, instr.Ops1, instr.Ops2, instr.Immediate, instr.S, instr.Value)
+			fmt.Fprintf(vm.trace, "instruction: %032b (%s)\n", instr.Raw, instr)
+			fmt.Fprintf(vm.trace, "state: flags=%v\n", vm.flags)
+			fmt.Fprintf(vm.trace, "cond= %s m=%v op=%s (pc=%d) dst=r%d ops1=r%d ops2=r%d I=%v S=%v value=%v\n", instr.Cond, instr.Mode, instr.Op, pc, instr.Dst, instr.Ops1, instr.Ops2, instr.Immediate, instr.S, instr.Value)
 		}
 
-		// boolean determining whether we should skip the instruction
-		// based on the instructions conditional value.
-		var skipInstr bool
-		switch instr.Cond {
-		case asm.Eq:
-			if conditionalValue != 0 {
-				skipInstr = true
-			}
-		case asm.Ne:
-			if conditionalValue == 0 {
-				skipInstr = true
-			}
-		case asm.Lt:
-			if conditionalValue >= 0 {
-				skipInstr = true
-			}
-		case asm.Gt:
-			if conditionalValue <= 0 {
-				skipInstr = true
-			}
-		case asm.Lte:
-			if conditionalValue < 0 {
-				skipInstr = true
-			}
-		case asm.Gte:
-			if conditionalValue > 0 {
-				skipInstr = true
-			}
+		// charge gas for the instruction, regardless of whether its
+		// condition allows it to be executed.
+		if err := vm.useGas(instr.Op); err != nil {
+			return err
 		}
-		// reset the conditional value once it has been read
-		conditionalValue = 0
 
-		// instructions are skipped based on the conditional value
-		// and the instruction condition.
-		if !skipInstr {
+		// instructions are skipped based on the instruction
+		// condition and the condition flags.
+		if vm.condition(instr.Cond) {
 			switch instr.Mode {
 			case asm.DataProcessing:
+				var (
+					result   uint32
+					carry    = vm.flags&FlagC != 0 // left unchanged unless the
+					overflow = vm.flags&FlagV != 0 // operation produces them
+				)
 				switch instr.Op {
 				case asm.Mov:
-					vm.Set(asm.Reg, uint32(instr.Dst), getOps1(vm, instr))
-					pc++
+					result = getOps1(vm, instr)
 				case asm.Add:
-					ops2 := getOps2(vm, instr)
-
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))+ops2)
-					pc++
-				case asm.Sub, asm.Rsb:
-					ops2 := getOps2(vm, instr)
-
-					var a, b uint32
-					if instr.Op == asm.Sub {
-						a, b = vm.Get(asm.Reg, uint32(instr.Ops1)), ops2
-					} else {
-						a, b = ops2, vm.Get(asm.Reg, uint32(instr.Ops1))
-					}
-					fmt.Println(a, b)
-
-					vm.Set(asm.Reg, uint32(instr.Dst), a-b)
-					pc++
+					result, carry, overflow = add(vm.Get(asm.Reg, uint32(instr.Ops1)), getOps2(vm, instr))
+				case asm.Sub:
+					result, carry, overflow = sub(vm.Get(asm.Reg, uint32(instr.Ops1)), getOps2(vm, instr))
+				case asm.Rsb:
+					result, carry, overflow = sub(getOps2(vm, instr), vm.Get(asm.Reg, uint32(instr.Ops1)))
 				case asm.Mul:
-					ops2 := getOps2(vm, instr)
-
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))*ops2)
-					pc++
+					result = vm.Get(asm.Reg, uint32(instr.Ops1)) * getOps2(vm, instr)
 				case asm.Div:
-					ops2 := getOps2(vm, instr)
-
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))/ops2)
-					pc++
+					// division by zero yields zero rather than a fault
+					if ops2 := getOps2(vm, instr); ops2 != 0 {
+						result = vm.Get(asm.Reg, uint32(instr.Ops1)) / ops2
+					}
 				case asm.And:
-					ops2 := getOps2(vm, instr)
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))&ops2)
-
-					pc++
+					result = vm.Get(asm.Reg, uint32(instr.Ops1)) & getOps2(vm, instr)
 				case asm.Xor:
-					ops2 := getOps2(vm, instr)
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))^ops2)
-
-					pc++
+					result = vm.Get(asm.Reg, uint32(instr.Ops1)) ^ getOps2(vm, instr)
 				case asm.Orr:
-					ops2 := getOps2(vm, instr)
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))|ops2)
-
-					pc++
+					result = vm.Get(asm.Reg, uint32(instr.Ops1)) | getOps2(vm, instr)
 				case asm.Lsl:
-					ops2 := getOps2(vm, instr)
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))<<ops2)
-
-					pc++
+					result, carry = lsl(vm.Get(asm.Reg, uint32(instr.Ops1)), getOps2(vm, instr), carry)
 				case asm.Lsr:
-					ops2 := getOps2(vm, instr)
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Reg, uint32(instr.Ops1))>>ops2)
-
-					pc++
+					result, carry = lsr(vm.Get(asm.Reg, uint32(instr.Ops1)), getOps2(vm, instr), carry)
+				case asm.Asr:
+					result, carry = asr(vm.Get(asm.Reg, uint32(instr.Ops1)), getOps2(vm, instr), carry)
+				case asm.Ror:
+					result, carry = ror(vm.Get(asm.Reg, uint32(instr.Ops1)), getOps2(vm, instr), carry)
+				case asm.Movw:
+					result = instr.Value
+				case asm.Movt:
+					result = vm.Get(asm.Reg, uint32(instr.Dst))&0xffff | instr.Value<<16
 				case asm.Cmp:
-					conditionalValue = int32(vm.Get(asm.Reg, uint32(instr.Dst)) - vm.Get(asm.Reg, uint32(instr.Ops1)))
-					pc++
+					result, carry, overflow = sub(vm.Get(asm.Reg, uint32(instr.Dst)), getOps1(vm, instr))
 				default:
 					return fmt.Errorf("invalid opcode: %d", instr.Op)
 				}
+				// cmp only sets the flags and always does so
+				if instr.Op != asm.Cmp {
+					vm.Set(asm.Reg, uint32(instr.Dst), result)
+				}
+				if instr.S || instr.Op == asm.Cmp {
+					vm.setFlags(result, carry, overflow)
+				}
+				pc++
+			case asm.Arithmetic:
+				var (
+					ops1   = vm.Get(asm.Reg, uint32(instr.Ops1))
+					ops2   = getOps2(vm, instr)
+					result uint32
+				)
+				// division by zero yields zero and the remainder of a
+				// division by zero is the dividend, such that
+				// ops1 == ops1/ops2*ops2 + ops1%ops2 always holds.
+				switch instr.Op {
+				case asm.Sdiv:
+					if ops2 != 0 {
+						result = uint32(int32(ops1) / int32(ops2))
+					}
+				case asm.Mod:
+					result = ops1
+					if ops2 != 0 {
+						result = ops1 % ops2
+					}
+				case asm.Smod:
+					result = ops1
+					if ops2 != 0 {
+						result = uint32(int32(ops1) % int32(ops2))
+					}
+				case asm.Mla:
+					result = ops1*ops2 + vm.Get(asm.Reg, uint32(instr.Ops3))
+				default:
+					return fmt.Errorf("invalid opcode: %d", instr.Op)
+				}
+				vm.Set(asm.Reg, uint32(instr.Dst), result)
+				if instr.S {
+					vm.setFlags(result, vm.flags&FlagC != 0, vm.flags&FlagV != 0)
+				}
+				pc++
 			case asm.DataTransfer:
 				switch instr.Op {
 				case asm.Ldm:
-					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Mem, getOps1(vm, instr)))
+					addr, err := vm.address(instr)
+					if err != nil {
+						return err
+					}
+					if err := vm.checkMem(addr, MemRead, pc, instr); err != nil {
+						return err
+					}
+					vm.writeback(instr)
+					vm.Set(asm.Reg, uint32(instr.Dst), vm.Get(asm.Mem, addr))
 
 					pc++
 				case asm.Stm:
-					vm.Set(asm.Mem, getOps1(vm, instr), vm.Get(asm.Reg, uint32(instr.Dst)))
+					addr, err := vm.address(instr)
+					if err != nil {
+						return err
+					}
+					if err := vm.checkMem(addr, MemWrite, pc, instr); err != nil {
+						return err
+					}
+					vm.Set(asm.Mem, addr, vm.Get(asm.Reg, uint32(instr.Dst)))
+					vm.writeback(instr)
+					pc++
+				case asm.Ldrb, asm.Ldrh:
+					addr, err := vm.address(instr)
+					if err != nil {
+						return err
+					}
+					value, err := vm.load(addr, transferSize(instr.Op), pc, instr)
+					if err != nil {
+						return err
+					}
+					vm.writeback(instr)
+					vm.Set(asm.Reg, uint32(instr.Dst), value)
+					pc++
+				case asm.Strb, asm.Strh:
+					addr, err := vm.address(instr)
+					if err != nil {
+						return err
+					}
+					if err := vm.store(addr, transferSize(instr.Op), vm.Get(asm.Reg, uint32(instr.Dst)), pc, instr); err != nil {
+						return err
+					}
+					vm.writeback(instr)
+					pc++
+				case asm.Push:
+					if err := vm.push(instr, pc); err != nil {
+						return err
+					}
 					pc++
+				case asm.Pop:
+					if err := vm.pop(instr, pc); err != nil {
+						return err
+					}
+					pc++
+				default:
+					return fmt.Errorf("invalid opcode: %d", instr.Op)
 				}
 			case asm.Branching:
 				switch instr.Op {
-				case asm.Call:
-					callStack = append(callStack, pc+1)
-					vm.Set(asm.Reg, uint32(asm.R15), instr.Value)
+				case asm.Bl:
+					// the offset is relative to the call itself
+					vm.Set(asm.Reg, asm.LR, pc+1)
+					vm.Set(asm.Reg, asm.PC, pc+instr.Value)
+				case asm.Blx:
+					target := vm.Get(asm.Reg, uint32(instr.Ops1))
+					vm.Set(asm.Reg, asm.LR, pc+1)
+					vm.Set(asm.Reg, asm.PC, target)
+				case asm.Bx:
+					vm.Set(asm.Reg, asm.PC, vm.Get(asm.Reg, uint32(instr.Ops1)))
+				case asm.B:
+					// the offset is relative to the branch itself
+					vm.Set(asm.Reg, asm.PC, pc+instr.Value)
 				case asm.Ret:
-					if len(callStack) == 0 {
-						return nil
+					vm.Set(asm.Reg, asm.PC, vm.Get(asm.Reg, asm.LR))
+				case asm.Svc:
+					if err := vm.syscall(instr.Value, pc); err != nil {
+						return err
 					}
-					pc = callStack[len(callStack)-1]
-					callStack = callStack[:len(callStack)-1]
+					pc++
+				case asm.Stop:
+					vm.halted, vm.exitCode = true, getOps1(vm, instr)
+					return nil
+				default:
+					return fmt.Errorf("invalid opcode: %d", instr.Op)
 				}
-			}
-			// set conditional value if S is set
-			if instr.S {
-				conditionalValue = int32(vm.Get(asm.Reg, uint32(instr.Dst)))
+			default:
+				return fmt.Errorf("invalid instruction mode: %d", instr.Mode)
 			}
 		} else {
 			// increment the program counter
@@ -258,26 +474,33 @@ func (vm *VM) Exec(code []byte) error {
 		if branch == vm.registers[15] {
 			vm.registers[15] = pc
 		}
-		instrPos = vm.registers[15] * 4
+		instrPos = uint64(vm.registers[15]) * 4
 	}
 
 	return nil
 }
 
-// Stats prints the virtual machine internal statistics.
+// ExitCode returns the exit code passed to the stop instruction and whether
+// the last execution was halted by a stop instruction.
+func (vm *VM) ExitCode() (uint32, bool) {
+	return vm.exitCode, vm.halted
+}
+
+// Stats prints the virtual machine internal statistics to the trace
+// writer of the configuration (os.Stdout by default).
 func (vm *VM) Stats() {
-	fmt.Println("regs:")
+	fmt.Fprintln(vm.trace, "regs:")
 	for register, value := range vm.registers {
-		fmt.Println(asm.RegToString[asm.RegEntry(register)], ":", value)
+		fmt.Fprintln(vm.trace, asm.RegToString[asm.RegEntry(register)], ":", value)
 	}
 
-	fmt.Println()
+	fmt.Fprintln(vm.trace)
 
-	fmt.Println("mem:")
+	fmt.Fprintln(vm.trace, "mem:")
 	for addr, value := range vm.memory {
 		buff := new(bytes.Buffer)
 		binary.Write(buff, binary.BigEndian, value)
-		fmt.Printf("%04d: % x  ", addr, buff.Bytes())
+		fmt.Fprintf(vm.trace, "%04d: % x  ", addr, buff.Bytes())
 
 		var str string
 		for _, r := range buff.Bytes() {
@@ -289,8 +512,8 @@ func (vm *VM) Stats() {
 				str += "?"
 			}
 		}
-		fmt.Println(str)
+		fmt.Fprintln(vm.trace, str)
 	}
 
-	fmt.Println()
+	fmt.Fprintln(vm.trace)
 }
@@ -1,7 +1,13 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/obscuren/tinyvm/asm"
 )
@@ -23,6 +29,67 @@ func TestExecution(t *testing.T) {
 		{"mov r0 #1\norr r0 r0 #2", 3},
 		{"mov r0 #1\nlsl r0 r0 #1", 2},
 		{"mov r0 #2\nlsr r0 r0 #1", 1},
+		{"mov r0 #7\ndiv r0 r0 #0", 0},
+		{"mov r0 #7\nudiv r0 r0 #2", 3},
+		{"mov r1 #0\nsub r1 r1 #7\nsdiv r0 r1 #2", 0xfffffffd}, // -7 / 2 = -3
+		{"mov r0 #7\nsdiv r0 r0 #0", 0},                        // division by zero
+		{"mov r1 #1\nlsl r1 r1 #31\nmov r2 #0\nsub r2 r2 #1\nsdiv r0 r1 r2", 0x80000000}, // MinInt32 / -1
+		{"mov r0 #7\nmod r0 r0 #3", 1},
+		{"mov r0 #7\nmod r0 r0 #0", 7},
+		{"mov r1 #0\nsub r1 r1 #7\nsmod r0 r1 #3", 0xffffffff}, // -7 % 3 = -1
+		{"mov r1 #0\nsub r1 r1 #7\nsmod r0 r1 #0", 0xfffffff9}, // -7 % 0 = -7
+		{"mov r1 #0\nsub r1 r1 #8\nasr r0 r1 #1", 0xfffffffc},  // -8 >> 1 = -4
+		{"mov r1 #8\nasr r0 r1 #2", 2},
+		{"mov r1 #1\nror r0 r1 #1", 0x80000000},
+		{"mov r1 #3\nmov r2 #4\nmov r3 #5\nmla r0 r1 r2 r3", 17},
+		{"mov r0 #257", 257},
+		{"mov r0 #4294967295", 0xffffffff},
+		{"ldr r0 =305419896", 0x12345678},
+		{"mov r0 #1\nmovt r0 #2", 0x20001},
+		{"movw r0 #65535", 0xffff},
+		{"mov r0 #0\nsubs r0 r0 #1\nmovne r0 #70000", 70000},
+		{"ldr r0 =data\nstop\ndata:", 3},
+		{"ldr r0 =0x12345678", 0x12345678},
+		{"mov r0 #0xff", 0xff},
+		{"mov r0 #0b1010", 10},
+		{"mov r0 #'A'", 65},
+		{"mov r0 #-1", 0xffffffff},
+		{"mov r0 #1\nadd r0 r0 #-1", 0},
+		{"mov r0 #1\nsub r0 r0 #-2", 3},
+		{"mov r0 #0\nsubs r0 r0 #-1\nmovne r0 #0x100", 0x100},
+		{".equ SIZE 4\nmov r0 #(SIZE*4+1)", 17},
+		{"mov r0 #(SIZE << 2 | 1)\n.equ SIZE 4", 17},
+		{".equ A B+1\n.equ B 2\nmov r0 #A*A", 9},
+		{".set N 1\nmov r0 #N\n.set N N+1\nadd r0 r0 #N", 3},
+		{".equ N -1\nmov r1 #5\nadd r0 r1 #N", 4},
+		{"mov r0 #(end-start)\nstart:\nmov r1 #0\nmov r1 #0\nend:", 2},
+		{"mov r0 #0\nmov r15 skip+1\nskip:\nmov r0 #1\nmov r1 #2", 0},
+		{"ldr r0 =data+2\nstop\ndata:", 5},
+		{"mov r0 #'a'-'A'", 32},
+		{"mov r0 #~0xff", 0xffffff00},
+		{".macro inc reg, n=1\n\tadd \\reg \\reg #\\n\n.endm\nmov r0 #1\ninc r0\ninc r0 3", 5},
+		{".macro max dst a b\n\tcmp \\a \\b\n\tmov \\dst \\a\n\tmovlt \\dst \\b\n.endm\nmov r1 #3\nmov r2 #7\nmax r0 r1 r2", 7},
+		{".macro count n\n\tmov r1 #\\n\nloop\\@:\n\tadd r0 r0 #1\n\tsubs r1 r1 #1\n\tmovne pc loop\\@\n.endm\ncount 3\ncount 2", 5},
+		{".macro twice m\n\t\\m\n\t\\m\n.endm\n.macro one\n\tadd r0 r0 #1\n.endm\ntwice one", 2},
+		{"bl f\nstop\nf: mov r0 lr\nbx lr", 1},
+		{"bl f\nstop\n" + strings.Repeat("mov r1 #0\n", 301) + "f: mov r0 #3\nret", 3}, // calls beyond 255
+		{"ldr r4 =f\nblx r4\nstop\nf: mov r0 lr\nret", 3},
+		{"bl f\nadd r0 r0 #1\nstop\nf: push lr\nbl g\npop lr\nbx lr\ng: mov r0 #10\nret", 11},
+		{"mov r4 #3\nbx r4\nmov r0 #1\nstop", 0},
+		{"mov r0 #1\nret\nmov r0 #2", 1}, // returns to ExitAddress
+		{"b skip\nmov r0 #1\nskip: add r0 r0 #2", 2},
+		{"mov r1 #3\nloop: add r0 r0 #2\nsubs r1 r1 #1\nbne loop", 6},
+		{"mov r1 #1\ncmp r1 #2\nblt less\nmov r0 #1\nstop\nless: mov r0 #2", 2},
+		{"mov r1 #7\nmov r2 #100\nstm r1 [r2, #-4]\nldm r0 #96", 7},
+		{"mov r1 #7\nmov r2 #100\nmov r3 #5\nstm r1 [r2, r3]\nldm r0 #105", 7},
+		{"mov r1 #7\nmov r2 #100\nstm r1 [r2, #4]!\nldm r0 r2", 7},                  // pre-indexed
+		{"mov r1 #7\nmov r2 #100\nstm r1 [r2], #4\nldm r0 #100\nadd r0 r0 r2", 111}, // post-indexed
+		{"mov r1 #100\nstm r1 [r1], #1\nldm r0 [r1, #-1]", 100},
+		{"mov r1 #100\nstm r1 r1\nldm r1 [r1], #1\nmov r0 r1", 100}, // load takes precedence over write back
+		{"mov r1 #0x1234\nmov r2 #400\nstrh r1 [r2, #2]!\nldrb r0 [r2, #1]", 0x34},
+		{"mov r1 #3\nmov r2 #200\nloop: stm r1 [r2], #1\nsubs r1 r1 #1\nbne loop\nldm r0 [r2, #-3]", 3},
+		{"b #2\nmov r0 #1\nadd r0 r0 #2", 2},
+		{"b end\n.macro nops\nmov r1 #0\nmov r1 #0\n.endm\nback: mov r0 #5\nstop\nnops\nnops\nend: b back", 5},
 	} {
 		code, err := asm.Assemble(test.code)
 		if err != nil {
@@ -51,6 +118,10 @@ func TestStack(t *testing.T) {
 		{"mov r0 #1\npush r0\npush r0", 1, 0, StackSize - 3},    // double push r0
 		{"mov r0 #1\npush r0\npop r1", 1, 1, StackSize - 1},     // push r0 pop in to r1
 		{"mov r0 #1\npush r0\nldm r1 r13", 1, 1, StackSize - 2}, // push r0 manual store sp pos in r1
+		{"mov r0 #1\nmov r1 #2\npush {r0, r1}\npop {r1}", 1, 1, StackSize - 2},
+		{"mov r0 #1\nmov r1 #2\npush {r0-r1}\npop {r0, r1}", 1, 2, StackSize - 1},
+		{"mov r0 #1\nmov r1 #2\npush {r0, r1}\nldm r0 r13\npop r1\npop r1", 1, 2, StackSize - 1}, // lowest register at lowest address
+		{"bl f\nstop\nf: push {r4-r7, lr}\nmov r0 #3\nmov r1 #4\npop {r4-r7, pc}", 3, 4, StackSize - 1},
 	} {
 		code, err := asm.Assemble(test.code)
 		if err != nil {
@@ -74,3 +145,633 @@ func TestStack(t *testing.T) {
 		}
 	}
 }
+
+func TestStackFault(t *testing.T) {
+	for i, test := range []struct {
+		code  string
+		limit uint32
+		kind  StackFaultKind
+		sp    uint32
+		pc    uint32
+	}{
+		{"pop r0", 10, StackUnderflow, 31, 0},
+		{"push {r0-r3}\npop {r0-r4}", 10, StackUnderflow, 27, 1},
+		{"push {r0-r7}\npush {r0-r7}\npush {r0-r3}\npush {r0, r1}", 10, StackOverflow, 11, 3},
+		{"push {r0-r12, r14, r15}\npush {r0-r12, r14, r15}\npush {r0, r1}", 0, StackOverflow, 1, 2},
+	} {
+		code, err := asm.Assemble(test.code)
+		if err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		vm := NewWithConfig(Config{MemorySize: 32, StackBase: stackBase(31), StackLimit: test.limit})
+		var fault *StackFault
+		if err := vm.Exec(code); !errors.As(err, &fault) {
+			t.Errorf("%d failed: expected *StackFault, got %v", i, err)
+			continue
+		}
+		if fault.Kind != test.kind || fault.SP != test.sp || fault.PC != test.pc {
+			t.Errorf("%d failed: expected %s with sp %d at pc %d, got %s with sp %d at pc %d", i, test.kind, test.sp, test.pc, fault.Kind, fault.SP, fault.PC)
+		}
+		if sp := vm.Get(asm.Reg, asm.SP); sp != test.sp {
+			t.Errorf("%d failed: expected sp to be unchanged, got %d", i, sp)
+		}
+	}
+}
+
+func TestGas(t *testing.T) {
+	code, err := asm.Assemble("loop:\n\tmov r0 #1\n\tmov r15 loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := New(false)
+	vm.SetGasLimit(100)
+	if err := vm.Exec(code); err != ErrOutOfGas {
+		t.Fatalf("expected %v, got %v", ErrOutOfGas, err)
+	}
+	if used := vm.GasUsed(); used != 100 {
+		t.Errorf("expected 100 gas used, got %d", used)
+	}
+
+	code, err = asm.Assemble("mov r0 #2\nmul r0 r0 #2\ndiv r0 r0 #2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm = New(false)
+	vm.SetGasTable(GasTable{asm.Mul: 10})
+	if err := vm.Exec(code); err != nil {
+		t.Fatal(err)
+	}
+	// mov and div fall back to the default cost
+	if used, exp := vm.GasUsed(), uint64(10+2*DefaultGasCost); used != exp {
+		t.Errorf("expected %d gas used, got %d", exp, used)
+	}
+
+	// gas tables are copied, changing them doesn't affect existing VMs
+	table := GasTable{asm.Mul: 10}
+	vm = New(false)
+	vm.SetGasTable(table)
+	table[asm.Mul] = 1
+	if err := vm.Exec(code); err != nil {
+		t.Fatal(err)
+	}
+	if used, exp := vm.GasUsed(), uint64(10+2*DefaultGasCost); used != exp {
+		t.Errorf("expected %d gas used after changing the table, got %d", exp, used)
+	}
+	vm = New(false)
+	DefaultGasTable[asm.Mul] += 100
+	defer func() { DefaultGasTable[asm.Mul] -= 100 }()
+	if err := vm.Exec(code); err != nil {
+		t.Fatal(err)
+	}
+	if used, exp := vm.GasUsed(), DefaultGasTable[asm.Mov]+DefaultGasTable[asm.Mul]-100+DefaultGasTable[asm.Div]; used != exp {
+		t.Errorf("expected %d gas used after changing the default table, got %d", exp, used)
+	}
+}
+
+func TestExecContext(t *testing.T) {
+	code, err := asm.Assemble("loop:\n\tadd r0 r0 #1\n\tmov r15 loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	vm := New(false)
+	err = vm.ExecContext(ctx, code)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("expected *ExecError, got %T", err)
+	}
+	if execErr.Steps == 0 {
+		t.Errorf("expected instructions to be executed before the deadline")
+	}
+	if execErr.PC > 1 {
+		t.Errorf("expected pc within the loop, got %d", execErr.PC)
+	}
+
+	// cancelled contexts must stop execution before the first instruction
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	vm = New(false)
+	if err := vm.ExecContext(ctx, code); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if r0 := vm.Get(asm.Reg, asm.R0); r0 != 0 {
+		t.Errorf("expected r0 to be 0, got %d", r0)
+	}
+}
+
+func TestSyscall(t *testing.T) {
+	code, err := asm.Assemble("mov r0 #3\nmov r1 #2\nsvc #257\nadd r0 r0 #1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := New(false)
+	add := func(vm *VM) error {
+		vm.Set(asm.Reg, asm.R0, vm.Get(asm.Reg, asm.R0)+vm.Get(asm.Reg, asm.R1))
+		return nil
+	}
+	// moving add to another number and replacing its old number keeps
+	// both names
+	vm.RegisterSyscall(1, "add", add)
+	vm.RegisterSyscall(257, "add", add)
+	vm.RegisterSyscall(1, "nop", func(vm *VM) error { return nil })
+	for name, exp := range map[string]uint32{"add": 257, "nop": 1} {
+		if num, ok := vm.SyscallNumber(name); !ok || num != exp {
+			t.Errorf("expected syscall %s to be registered as %d, got %d (%v)", name, exp, num, ok)
+		}
+	}
+	if err := vm.Exec(code); err != nil {
+		t.Fatal(err)
+	}
+	if r0 := vm.Get(asm.Reg, asm.R0); r0 != 6 {
+		t.Errorf("expected r0 to be 6, got %d", r0)
+	}
+
+	// addresses passed by the program are checked
+	code, err = asm.Assemble("mov r0 #4096\nsvc #1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm = New(false)
+	vm.RegisterSyscall(1, "load", func(vm *VM) error {
+		value, err := vm.ReadMemory(vm.Get(asm.Reg, asm.R0))
+		if err != nil {
+			return err
+		}
+		return vm.WriteMemory(0, value)
+	})
+	var fault *MemoryFault
+	if err := vm.Exec(code); !errors.As(err, &fault) {
+		t.Fatalf("expected *MemoryFault, got %v", err)
+	}
+	if fault.Addr != 4096 || fault.Access != MemRead || fault.PC != 1 {
+		t.Errorf("expected read of 4096 at pc 1, got %s of %d at pc %d", fault.Access, fault.Addr, fault.PC)
+	}
+	if err := vm.WriteMemory(StackSize, 1); !errors.As(err, &fault) || fault.Access != MemWrite {
+		t.Errorf("expected write fault, got %v", err)
+	}
+
+	code, err = asm.Assemble("mov r0 #1\nsvc #2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sysErr *UnknownSyscallError
+	if err := New(false).Exec(code); !errors.As(err, &sysErr) {
+		t.Fatalf("expected *UnknownSyscallError, got %v", err)
+	}
+	if sysErr.Num != 2 || sysErr.PC != 1 {
+		t.Errorf("expected syscall 2 at pc 1, got %d at pc %d", sysErr.Num, sysErr.PC)
+	}
+}
+
+func TestMemoryFault(t *testing.T) {
+	for i, test := range []struct {
+		code   string
+		addr   uint32
+		access Access
+		pc     uint32
+	}{
+		{"mov r0 #1\nldm r0 #2048", 2048, MemRead, 1},
+		{"mov r0 #1\nstm r0 #2048", 2048, MemWrite, 1},
+		{"mov r1 #1024\nldm r0 r1", StackSize, MemRead, 1},
+		{"mov r1 #4096\nldrb r0 r1", 4 * StackSize, MemRead, 1},
+		{"mov r1 #4095\nstrh r0 r1", 4*StackSize - 1, MemWrite, 1},
+	} {
+		code, err := asm.Assemble(test.code)
+		if err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		var fault *MemoryFault
+		if err := New(false).Exec(code); !errors.As(err, &fault) {
+			t.Errorf("%d failed: expected *MemoryFault, got %v", i, err)
+			continue
+		}
+		if fault.Addr != test.addr || fault.Access != test.access || fault.PC != test.pc {
+			t.Errorf("%d failed: expected %s of %d at pc %d, got %s of %d at pc %d", i, test.access, test.addr, test.pc, fault.Access, fault.Addr, fault.PC)
+		}
+		if fault.Instr != binary.BigEndian.Uint32(code[test.pc*4:]) {
+			t.Errorf("%d failed: unexpected raw instruction %#08x", i, fault.Instr)
+		}
+	}
+}
+
+// FuzzExec ensures that executing arbitrary byte code never panics.
+func FuzzExec(f *testing.F) {
+	for _, src := range []string{
+		"mov r0 #10",
+		"mov r0 #2\ndiv r0 r0 #0",
+		"mov r0 #1\npush r0\npop r1",
+		"mov r15 main\nadd:\n\tadd r0 r0 r1\n\tret\nmain:\n\tcall add",
+		"mov r1 #10\nloop:\n\tsubs r1 r1 #1\n\tmovne r15 loop",
+		"ldm r0 #2048",
+		"svc #1",
+	} {
+		code, err := asm.Assemble(src)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(code)
+	}
+	f.Add([]byte{0xff, 0xff, 0xff})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, code []byte) {
+		vm := New(false)
+		vm.SetGasLimit(10000)
+		vm.Exec(code)
+	})
+}
+
+func TestConfig(t *testing.T) {
+	code, err := asm.Assemble("add r0 r0 r1\npush r0\nstm r0 #100\nloop:\n\tmov r15 loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		trace bytes.Buffer
+		regs  [asm.MaxRegister]uint32
+	)
+	regs[asm.R0], regs[asm.R1] = 3, 2
+
+	vm := NewWithConfig(Config{
+		MemorySize: 64,
+		StackBase:  stackBase(32),
+		Registers:  regs,
+		Debug:      true,
+		Trace:      &trace,
+		GasLimit:   20,
+	})
+	err = vm.Exec(code)
+	if err, ok := err.(*MemoryFault); !ok || err.Addr != 100 {
+		t.Fatalf("expected memory fault at address 100, got %v", err)
+	}
+	if r0 := vm.Get(asm.Reg, asm.R0); r0 != 5 {
+		t.Errorf("expected r0 to be 5, got %d", r0)
+	}
+	if sp := vm.Get(asm.Reg, asm.SP); sp != 31 {
+		t.Errorf("expected sp to be 31, got %d", sp)
+	}
+	if m := vm.Get(asm.Mem, 31); m != 5 {
+		t.Errorf("expected 5 on the stack, got %d", m)
+	}
+	if trace.Len() == 0 {
+		t.Error("expected debug output to be written to the trace writer")
+	}
+
+	// the gas limit is taken from the configuration
+	code, err = asm.Assemble("loop:\n\tadd r0 r0 #1\n\tmov r15 loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm = NewWithConfig(Config{GasLimit: 20})
+	if err := vm.Exec(code); err != ErrOutOfGas {
+		t.Fatalf("expected %v, got %v", ErrOutOfGas, err)
+	}
+}
+
+// stackBase returns a pointer to base for Config.StackBase.
+func stackBase(base uint32) *uint32 {
+	return &base
+}
+
+func TestConfigStack(t *testing.T) {
+	for i, test := range []struct {
+		cfg   Config
+		base  uint32
+		limit uint32
+	}{
+		{Config{MemorySize: 64}, 63, 0},
+		{Config{MemorySize: 64, StackBase: stackBase(32), StackLimit: 16}, 32, 16},
+		{Config{MemorySize: 64, StackBase: stackBase(0)}, 0, 0},
+		{Config{MemorySize: 64, StackBase: stackBase(100)}, 64, 0},
+		{Config{MemorySize: 64, StackBase: stackBase(32), StackLimit: 40}, 32, 32},
+	} {
+		vm := NewWithConfig(test.cfg)
+		if sp := vm.Get(asm.Reg, asm.SP); sp != test.base || vm.stackBase != test.base {
+			t.Errorf("%d failed: expected stack base %d, got sp %d base %d", i, test.base, sp, vm.stackBase)
+		}
+		if vm.stackLimit != test.limit {
+			t.Errorf("%d failed: expected stack limit %d, got %d", i, test.limit, vm.stackLimit)
+		}
+	}
+
+	// a stack at the end of the memory can be filled completely
+	code, err := asm.Assemble("push {r0-r3}\npop {r4-r7}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewWithConfig(Config{MemorySize: 4, StackBase: stackBase(4)}).Exec(code); err != nil {
+		t.Errorf("expected full stack to be usable, got %v", err)
+	}
+	var fault *StackFault
+	if err := NewWithConfig(Config{MemorySize: 4, StackBase: stackBase(0)}).Exec(code); !errors.As(err, &fault) || fault.Kind != StackOverflow {
+		t.Errorf("expected stack overflow of empty stack, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	var trace bytes.Buffer
+	vm := NewWithConfig(Config{MemorySize: 2, Trace: &trace})
+	vm.Set(asm.Mem, 0, 0x68690000)
+	vm.Stats()
+	if out := trace.String(); !strings.Contains(out, "r13 : 1") || !strings.Contains(out, "0000: 68 69 00 00  hi..") {
+		t.Errorf("unexpected stats output:\n%s", out)
+	}
+}
+
+func TestLoadData(t *testing.T) {
+	obj, _, err := asm.AssembleObject(`
+	ldr	r1 =count
+	ldm	r0 r1		; r0 = count
+	ldr	r1 =msg
+	ldm	r2 r1		; r2 = "hi!\0"
+	stop
+.data
+count:	.word	42
+msg:	.string	"hi!"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := New(false)
+	if err := vm.LoadData(obj.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Exec(obj.Code); err != nil {
+		t.Fatal(err)
+	}
+	if r0 := vm.Get(asm.Reg, asm.R0); r0 != 42 {
+		t.Errorf("expected r0 to be 42, got %d", r0)
+	}
+	if r2 := vm.Get(asm.Reg, asm.R2); r2 != 0x68692100 {
+		t.Errorf("expected r2 to be %#x, got %#x", 0x68692100, r2)
+	}
+
+	small := NewWithConfig(Config{MemorySize: 1})
+	if err := small.LoadData(obj.Data); err == nil {
+		t.Error("expected error loading data exceeding memory")
+	}
+}
+
+func TestByteAccess(t *testing.T) {
+	obj, _, err := asm.AssembleObject(`
+	ldr	r1 =msg*4	; byte address of msg
+	mov	r0 #0
+len:	ldrb	r2 r1
+	cmp	r2 #0
+	addne	r0 r0 #1
+	addne	r1 r1 #1
+	bne	len		; r0 = strlen(msg)
+	ldr	r1 =half*4
+	ldrh	r3 r1		; r3 = 0x1234
+	add	r1 r1 #1
+	ldrh	r4 r1		; r4 = 0x3456, unaligned
+	mov	r5 #0xab
+	strb	r5 #17		; second byte of word
+	ldr	r6 =0x12345678
+	strh	r6 #18
+	ldm	r7 #4		; word 4 holds bytes 16 to 19
+	ldm	r8 half		; data labels are word addresses for ldr
+	ldrb	r9 half		; and byte addresses for ldrb
+	mov	r11 #0
+	ldrh	r10 [r11, #half+1]
+	stop
+.data
+msg:	.string	"hello"
+.align
+half:	.byte	0x12, 0x34, 0x56
+.align
+	.word	0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := New(false)
+	if err := vm.LoadData(obj.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Exec(obj.Code); err != nil {
+		t.Fatal(err)
+	}
+	for reg, exp := range map[asm.RegEntry]uint32{
+		asm.R0:  5,
+		asm.R3:  0x1234,
+		asm.R4:  0x3456,
+		asm.R7:  0x00ab5678,
+		asm.R8:  0x12345600,
+		asm.R9:  0x12,
+		asm.R10: 0x3456,
+	} {
+		if v := vm.Get(asm.Reg, uint32(reg)); v != exp {
+			t.Errorf("expected %s to be %#x, got %#x", reg, exp, v)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	var modules []*asm.Module
+	for _, code := range []string{`
+.extern	square, n, msg, done
+	ldr	r1 =n
+	ldm	r0 r1
+	ldr	r3 =msg*4	; byte address of imported data
+	ldrb	r4 [r3, #1]
+	call	square
+	b	done
+` + strings.Repeat("\tmov r1 #0\n", 300), `
+.global	square, n, msg, done
+square:	mul	r0 r0 r0
+	ret
+done:	ldrb	r2 msg		; byte address of local data
+	stop	#7
+.data
+n:	.word	7
+msg:	.string	"hi"
+`} {
+		m, err := asm.AssembleModule(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modules = append(modules, m)
+	}
+	obj, _, err := asm.Link(modules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := New(false)
+	if err := vm.LoadData(obj.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Exec(obj.Code); err != nil {
+		t.Fatal(err)
+	}
+	for reg, exp := range map[asm.RegEntry]uint32{asm.R0: 49, asm.R2: 'h', asm.R4: 'i'} {
+		if v := vm.Get(asm.Reg, uint32(reg)); v != exp {
+			t.Errorf("expected %s to be %d, got %d", reg, exp, v)
+		}
+	}
+	if code, halted := vm.ExitCode(); !halted || code != 7 {
+		t.Errorf("expected exit code 7, got %d (halted %v)", code, halted)
+	}
+}
+
+func TestCall(t *testing.T) {
+	p, err := asm.AssembleProgram(`
+	stop	#1
+add:	add	r0 r0 r1
+	ret
+sum3:	push	lr		; nested calls spill lr
+	bl	add
+	pop	lr
+	add	r0 r0 r2
+	bx	lr
+scale:	ldr	r1 =factor
+	ldm	r1 r1
+	mul	r0 r0 r1
+	ret
+.data
+factor:	.word	10
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := New(false)
+	if _, err := vm.Call("add", 3, 2); err != ErrNoProgram {
+		t.Errorf("expected ErrNoProgram, got %v", err)
+	}
+	if err := vm.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		name string
+		args []uint32
+		want uint32
+	}{
+		{"add", []uint32{3, 2}, 5},
+		{"sum3", []uint32{1, 2, 3}, 6},
+		{"scale", []uint32{4}, 40},
+	} {
+		r0, err := vm.Call(test.name, test.args...)
+		if err != nil {
+			t.Errorf("%d failed: %v", i, err)
+		} else if r0 != test.want {
+			t.Errorf("%d failed: expected %d, got %d", i, test.want, r0)
+		}
+	}
+	if _, err := vm.Call("mul", 1); err == nil {
+		t.Error("expected error calling undefined symbol")
+	}
+	if _, err := vm.Call("add", 1, 2, 3, 4, 5); err == nil {
+		t.Error("expected error passing too many arguments")
+	}
+
+	// the program itself starts at its entry point
+	if err := vm.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if code, halted := vm.ExitCode(); !halted || code != 1 {
+		t.Errorf("expected exit code 1, got %d (halted %v)", code, halted)
+	}
+
+	// calls restore the program counter, such that the program still
+	// runs from its entry point afterwards
+	if err := vm.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Call("add", 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	if pc, lr := vm.Get(asm.Reg, asm.PC), vm.Get(asm.Reg, asm.LR); pc != p.Entry || lr != ExitAddress {
+		t.Errorf("expected pc %d and lr %#x after call, got %d and %#x", p.Entry, uint32(ExitAddress), pc, lr)
+	}
+	if err := vm.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if code, halted := vm.ExitCode(); !halted || code != 1 {
+		t.Errorf("expected exit code 1 after call, got %d (halted %v)", code, halted)
+	}
+}
+
+func TestStop(t *testing.T) {
+	for i, test := range []struct {
+		code     string
+		r0       uint32
+		exitCode uint32
+		halted   bool
+	}{
+		{"mov r0 #1\nstop\nmov r0 #2", 1, 0, true},
+		{"mov r0 #1\nstop #3\nmov r0 #2", 1, 3, true},
+		{"mov r0 #1\nmov r1 #4\nhalt r1\nmov r0 #2", 1, 4, true},
+		{"mov r0 #1\ncmp r0 r0\nstopne #5\nmov r0 #2", 2, 0, false},
+	} {
+		code, err := asm.Assemble(test.code)
+		if err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		vm := New(false)
+		if err := vm.Exec(code); err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		if r0 := vm.Get(asm.Reg, asm.R0); r0 != test.r0 {
+			t.Errorf("%d failed: expected r0 to be %d, got %d", i, test.r0, r0)
+		}
+		if exitCode, halted := vm.ExitCode(); exitCode != test.exitCode || halted != test.halted {
+			t.Errorf("%d failed: expected exit code %d (halted=%v), got %d (halted=%v)", i, test.exitCode, test.halted, exitCode, halted)
+		}
+	}
+}
+
+func TestConditions(t *testing.T) {
+	for i, test := range []struct {
+		code  string
+		r0    uint32
+		flags Flags
+	}{
+		{"mov r1 #1\ncmp r1 #2\nmov r2 #0\nmovlt r0 #1", 1, FlagN},                // flags persist
+		{"mov r1 #1\nsubs r1 r1 #1\nadd r2 r2 #1\nmoveq r0 #1", 1, FlagZ | FlagC}, // S flag
+		{"mov r1 #1\ncmp r1 #2\nmovlo r0 #1\nmovhs r0 #2", 1, FlagN},
+		{"mov r1 #2\ncmp r1 #2\nmovhs r0 #1\nmovls r0 #2\nmovhi r0 #3", 2, FlagZ | FlagC},
+		{"mov r1 #0\nsub r1 r1 #1\ncmp r1 #1\nmovhi r0 #1", 1, FlagN | FlagC}, // unsigned
+		{"mov r1 #0\nsub r1 r1 #1\ncmp r1 #1\nmovlt r0 #1", 1, FlagN | FlagC}, // signed
+		{"mov r1 #3\ncmp r1 #2\nmovgt r0 #1\nmovgte r0 #2\nmovle r0 #3", 2, FlagC},
+		{"mov r1 #1\nlsl r1 r1 #31\nsubs r1 r1 #1\nmovvs r0 #1\nmovvc r0 #2", 1, FlagC | FlagV},
+		{"mov r1 #0\nsub r1 r1 #1\nadds r1 r1 #1\nmovcs r0 #1\nmovcc r0 #2", 1, FlagZ | FlagC},
+		{"mov r1 #3\nlsrs r1 r1 #1\nmovcs r0 #1", 1, FlagC},
+		{"mov r1 #3\nlsls r1 r1 #31\nmovcs r0 #1", 1, FlagN | FlagC},
+		{"mov r1 #0\nsubs r1 r1 #1\nmovmi r0 #1\nmovpl r0 #2", 1, FlagN},
+		{"moval r0 #1", 1, 0},
+	} {
+		code, err := asm.Assemble(test.code)
+		if err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		vm := New(false)
+		if err := vm.Exec(code); err != nil {
+			t.Errorf("%d failed: %v", i, err)
+			continue
+		}
+		if r0 := vm.Get(asm.Reg, asm.R0); r0 != test.r0 {
+			t.Errorf("%d failed: expected r0 to be %d, got %d", i, test.r0, r0)
+		}
+		if flags := vm.Flags(); flags != test.flags {
+			t.Errorf("%d failed: expected flags %v, got %v", i, test.flags, flags)
+		}
+	}
+}